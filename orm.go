@@ -9,12 +9,12 @@ package orm
 import (
 	"database/sql"
 	"fmt"
-	"net/url"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	//	"time"
-	"encoding/json"
 	"webgo/logger"
 	"webgo/utils"
 
@@ -30,33 +30,46 @@ type (
 		_cls_type     reflect.Type
 		Name          string
 		Fields        map[string]*TField
-		RecordField   *TField // 表的唯一主键字段 自增/主键/唯一 如：Id
-		InheritFields map[string]*TRelateField
-		Inherits      []string          //Pg数据库表继承
-		Relations     map[string]string // many2many many2one... 等关联表
+		RecordField   *TField                  // 表的唯一主键字段 自增/主键/唯一 如：Id
+		InheritFields map[string]*TRelateField // 委托继承的父表字段
+		Inherits      []string                 //Pg数据库表继承
+		Relations     map[string]string        // many2many many2one... 等关联表
 		RelateFields  map[string]*TRelateField
 	}
 
 	TOrm struct {
 		*orm.Engine
 
-		TagIdentifier string // tag 标记
-		Tables        map[reflect.Type]*TTable
-
-		nameIndex map[string]*TTable
-		//DBName  string      // 绑定的数据库名称
-		//DBRead  *orm.Engine // 读写分离
-		//DBWrite *orm.Engine // 读写分离
+		TagIdentifier  string // tag 标记
+		Tables         map[reflect.Type]*TTable
+		IndexPolicy    TIndexPolicy // 同步时 Model 中不存在的索引的处理方式
+		AllowNarrowing bool         // 同步时允许可能丢失数据的字段类型变更
+
+		nameIndex   map[string]*TTable
+		modelLock   sync.RWMutex                 // 替换 Tables nameIndex Engine.Tables 时加锁 See registerModels()
+		staged      map[reflect.Type]*core.Table // 生成计划的副本中本批 Model 的原始表 See stageModels()
+		dbName      string                       // 绑定的数据库名称
+		config      *TDbConfig                   // 连接配置
+		replicas    []*tReplica                  // 读写分离的只读库
+		replicaNext uint32
 	}
 
 	TOrmSession struct {
 		*orm.Session
-		Orm *TOrm
+		Orm        *TOrm
+		useMaster  bool            // 读取在主库执行
+		privileged bool            // 允许写入只读字段 See Sudo()
+		writeDepth int             // 嵌套写入层数 最外层写入结束时清除 privileged
+		cols       map[string]bool // Cols() 指定的字段 写入检查只检查这些字段
+		mustCols   map[string]bool // MustCols() 指定的字段 零值也检查
+		allCols    bool            // AllCols() 所有字段的零值也检查
 	}
 )
 
+// NewOrm 使用的默认连接配置 多个数据库使用 TDbConfig 及 TRegistry
+// DbType 为 sqlite3 时数据库名为文件路径 需由应用导入驱动 github.com/mattn/go-sqlite3
 var (
-	DbType       string = "postgres"
+	DbType       string = "postgres" // postgres/mysql/sqlite3
 	DbUser       string = "postgres"
 	DbPassword   string = "postgres"
 	DbMasterHost string = "localhost:5432"
@@ -66,46 +79,55 @@ var (
 	TestShowSql bool   = true
 )
 
+// 以全局变量 DbType DbUser 等连接数据库 See NewOrmConfig()
 func NewOrm(db, host string) (res *TOrm, err error) {
+	lConfig := &TDbConfig{
+		Type:     DbType,
+		User:     DbUser,
+		Password: DbPassword,
+		Host:     host,
+		SSLMode:  DbSSLMode,
+		ShowSql:  TestShowSql,
+	}
+	for _, lHost := range strings.Split(DbSlaveHost, ",") {
+		// 与主库相同的地址被忽略 sqlite3 无只读库
+		if lHost = strings.TrimSpace(lHost); lHost != "" && lHost != host && DbType != "sqlite3" {
+			lConfig.Replicas = append(lConfig.Replicas, lHost)
+		}
+	}
+	return NewOrmConfig(db, lConfig)
+}
+
+// 以 config 连接数据库 db
+func NewOrmConfig(db string, config *TDbConfig) (res *TOrm, err error) {
 	res = &TOrm{
 		Tables:    make(map[reflect.Type]*TTable),
 		nameIndex: make(map[string]*TTable),
-	}
-
-	lCnnstr := ""
-
-	switch DbType {
-	case "mysql":
-		if DbMasterHost[0] == '/' { // looks like a unix socket
-			lCnnstr = fmt.Sprintf("%s:%s@unix(%s)/%s?charset=utf8&parseTime=true",
-				DbUser, DbPassword, host, db)
-		} else {
-			lCnnstr = fmt.Sprintf("%s:%s@tcp(%s)/%s?charset=utf8&parseTime=true",
-				DbUser, DbPassword, host, db)
-		}
-	case "postgres":
-		lCnnstr = fmt.Sprintf("postgres://%s:%s@%s/%s?sslmode=%s",
-			url.QueryEscape(DbUser), url.QueryEscape(DbPassword), host, db, DbSSLMode)
-	default:
-		return nil, fmt.Errorf("Unknown database type: %s", DbType)
+		dbName:    db,
+		config:    config,
 	}
 
 	//数据库链接
-	res.Engine, err = orm.NewEngine(DbType, lCnnstr)
-	res.Engine.TagIdentifier = "field"
-	if !logger.LogErr(err) {
-		//控制台打印SQL语句
-		res.Engine.ShowSQL(TestShowSql)
+	res.Engine, err = newEngine(config, db, config.Host)
+	if err != nil {
+		return nil, err
+	}
 
-		//控制台打印调试信息
-		//res.Engine.ShowDebug = true
+	//控制台打印调试信息
+	//res.Engine.ShowDebug = true
 
-		//控制台打印错误信息
-		//res.Engine.ShowErr = true
+	//控制台打印错误信息
+	//res.Engine.ShowErr = true
 
-		//控制台打印警告信息
-		//res.Engine.ShowWarn = false
+	//控制台打印警告信息
+	//res.Engine.ShowWarn = false
 
+	// 读写分离
+	for _, lHost := range config.Replicas {
+		if err = res.AddReplica(lHost); err != nil {
+			res.Close()
+			return nil, err
+		}
 	}
 	/*
 		// Mapping orm
@@ -135,18 +157,63 @@ func NewOrm(db, host string) (res *TOrm, err error) {
 	return
 }
 
+// 连接数据库 host 为主库或只读库地址
+func newEngine(config *TDbConfig, db, host string) (*orm.Engine, error) {
+	lCnnstr, err := config.dataSource(db, host)
+	if err != nil {
+		return nil, err
+	}
+
+	lEngine, err := orm.NewEngine(config.Type, lCnnstr)
+	if logger.LogErr(err) {
+		return nil, err
+	}
+	lEngine.TagIdentifier = "field"
+	lEngine.ShowSQL(config.ShowSql) //控制台打印SQL语句
+
+	// 内存数据库随最后一个连接关闭而销毁 只保持一个连接
+	if config.Type == "sqlite3" && isMemoryDb(db) {
+		lEngine.SetMaxOpenConns(1)
+		lEngine.SetMaxIdleConns(1)
+		return lEngine, nil
+	}
+
+	// 连接池
+	if config.MaxOpenConns > 0 {
+		lEngine.SetMaxOpenConns(config.MaxOpenConns)
+	}
+	if config.MaxIdleConns > 0 {
+		lEngine.SetMaxIdleConns(config.MaxIdleConns)
+	}
+	if config.ConnMaxLifetime > 0 {
+		lEngine.DB().SetConnMaxLifetime(config.ConnMaxLifetime)
+	}
+	return lEngine, nil
+}
+
 func NewTable(name string, t reflect.Type) *TTable {
 	return &TTable{
 		_cls_type:     t,
 		Name:          name,
 		Fields:        make(map[string]*TField),
-		InheritFields: make(map[string]*TRelateField), // 废弃
+		InheritFields: make(map[string]*TRelateField), // 委托继承
 		Inherits:      make([]string, 0),              //by hzm
 		Relations:     make(map[string]string),
 		RelateFields:  make(map[string]*TRelateField),
 	}
 }
 
+// 获取数据库字段名对应的字段
+// Fields 以成员名为Key 经 name(...) 重命名的字段需通过该方法查找
+func (self *TTable) FieldByColumn(col string) *TField {
+	for _, fld := range self.Fields {
+		if fld.Name == col {
+			return fld
+		}
+	}
+	return nil
+}
+
 func (v TExecResult) LastInsertId() (int64, error) {
 	return int64(v), nil
 }
@@ -156,13 +223,45 @@ func (v TExecResult) RowsAffected() (int64, error) {
 }
 
 func (self *TOrm) TableByName(name string) *TTable {
+	self.modelLock.RLock()
+	defer self.modelLock.RUnlock()
 	return self.nameIndex[name]
 }
 
+// 通过Model名称获取表 如 res.partner 对应表 res_partner
+func (self *TOrm) TableByModel(model string) *TTable {
+	self.modelLock.RLock()
+	defer self.modelLock.RUnlock()
+	if table, has := self.nameIndex[model]; has {
+		return table
+	}
+	return self.nameIndex[modelTableName(model)]
+}
+
+// Model名称对应的表名 如 res.partner 对应 res_partner
+func modelTableName(model string) string {
+	return utils.SnakeCasedName(strings.Replace(model, ".", "_", -1))
+}
+
 func (self *TOrm) TableByType(t reflect.Type) *TTable {
+	self.modelLock.RLock()
+	defer self.modelLock.RUnlock()
 	return self.Tables[t]
 }
 
+// 已注册的所有表 按表名排序 使生成的计划顺序固定
+func (self *TOrm) allTables() []*TTable {
+	self.modelLock.RLock()
+	res := make([]*TTable, 0, len(self.Tables))
+	for _, tbl := range self.Tables {
+		res = append(res, tbl)
+	}
+	self.modelLock.RUnlock()
+
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
 // TODO 更新表信息
 func (self *TOrm) _updateTable(table string) {
 	//for self.Engine.Dialect().GetColumns()
@@ -178,180 +277,257 @@ func (self *TOrm) NewSession() *TOrmSession {
 	return session
 }
 
-func splitTag(tag string) (tags []string) {
-	tag = strings.TrimSpace(tag)
-	var hasQuote = false
-	var lastIdx = 0
-	for i, t := range tag {
-		if t == '(' || t == ')' { // t == '\''
-			hasQuote = !hasQuote
-		} else if t == ' ' {
-			if lastIdx < i && !hasQuote {
-				tags = append(tags, strings.TrimSpace(tag[lastIdx:i]))
-				lastIdx = i + 1
-			}
-		}
+// 关联字段从源字段继承未设置的 String, Help, Selection, Size
+// 源字段所在的 Model 尚未映射时返回 false 待 SyncModel 时再设置
+func (self *TOrm) tag_related(tbl *TTable, fld *TField) bool {
+	lSource := self.relatedField(tbl, fld.Related, 0)
+	if lSource == nil {
+		return false
 	}
-	if lastIdx < len(tag) {
-		tags = append(tags, strings.TrimSpace(tag[lastIdx:len(tag)]))
+
+	if fld.Help == "" || fld.Help == fld.String {
+		fld.Help = lSource.Help
 	}
-	return
+	if fld.String == "" || fld.String == fld.Name {
+		fld.String = lSource.String
+	}
+	if fld.Selection == nil {
+		fld.Selection = lSource.Selection
+	}
+	if fld.Size == 0 {
+		fld.Size = lSource.Size
+	}
+	return true
 }
 
-func parseTag(tag string) (tags []string) {
-	tag = strings.TrimSpace(tag)
-	var (
-		hasQuote          = false
-		hasSquareBrackets = false
-		lastIdx           = 0
-		l                 = len(tag)
-	)
-	for i, t := range tag {
-		//if t == '\'' {
-		//	hasQuote = !hasQuote
-		//} else
-		//fmt.Println(t,i)
-		if t == '[' || t == ']' {
-			hasSquareBrackets = !hasSquareBrackets
-		} else if t == '(' || t == ',' || t == ')' { //处理 Tag(xxx)类型
-			if lastIdx < i && !hasQuote && !hasSquareBrackets {
-				tags = append(tags, strings.TrimSpace(tag[lastIdx:i]))
-				lastIdx = i + 1
+// 沿 many2one 字段路径找到源字段
+func (self *TOrm) relatedField(tbl *TTable, path string, depth int) *TField {
+	if depth > 16 { // 循环关联
+		return nil
+	}
+
+	lNames := strings.Split(path, ".")
+	for idx, name := range lNames {
+		fld := tbl.FieldByColumn(name)
+		if fld == nil {
+			return nil
+		}
+
+		if idx == len(lNames)-1 {
+			if fld.IsRelatedPath() {
+				return self.relatedField(tbl, fld.Related, depth+1)
 			}
-		} else if i+1 == l { // 处理无括号类型的Tag
-			tags = append(tags, strings.TrimSpace(tag[lastIdx:l]))
+			return fld
 		}
 
+		if fld.Type != "many2one" {
+			return nil
+		}
+		if tbl = self.TableByModel(fld.comodel_name); tbl == nil {
+			return nil
+		}
 	}
-	//if lastIdx < len(tag) {
-	//	tags = append(tags, strings.TrimSpace(tag[lastIdx:len(tag)]))
-	//}
-	return
+	return nil
 }
 
-func (self *TOrm) tag_related(tbl *TTable, fld *TField) {
-	// 遍历获得原始字段 例如：Extends其他表的字段
-	/*	if fld.related && fld.relmodel_name != "" {
+// 设置关联字段的属性 未指定 tables 时设置所有表
+func (self *TOrm) setupRelated(tables ...*TTable) {
+	if len(tables) == 0 {
+		tables = self.allTables()
+	}
 
-			if table, has := self.TableByName(fld.relmodel_name); !has {
-				self.SyncModel(reflect.Zero(table._cls_type).Interface())
-				logger.Dbg("tag_related", lFieldType)
-			}
-			// 添加Extend字段
-			lFieldTable := self.Tables[lFieldType]
-			if lFieldTable == nil {
-				logger.Logger.Error("extends failed!")
+	for _, tbl := range tables {
+		for _, fld := range tbl.Fields {
+			if fld.IsRelatedPath() {
+				self.tag_related(tbl, fld)
 			}
-			for _, fld := range lFieldTable.Fields {
-				//d待续
-
-				if _, has := lTable.Fields[fld.Name]; !has {
-					//lNewFld := fld.New()
-					//lNewFld._inherit = true
-					//lNewFld.cokey_field_name=
-					//lNewFld.relkey_field_name=
-					lTable.Fields[fld.Name] = fld
-					logger.Dbg("5999fld", fld.Name)
-
-					if fld.primary_key && fld.auto_increment {
-						lTable.RecordField = fld
-						logger.Dbg("RecordField", fld.Name)
-					}
+		}
+	}
+}
 
-					// 记录继承字段
-					lModelName := utils.TitleCasedName(utils.DotCasedName(lFieldTable.Name))
-					lTable.InheritFields[fld.Name] = NewInheritField(fld.Name, lModelName, "", fld, nil)
-				}
+// 复制父表字段为经 many2one 字段关联的字段 父表主键作为本表主键
+func (self *TOrm) delegateFields(tbl *TTable, orgTable *core.Table, parent *TTable, parentTable *core.Table, m2o string, index int) {
+	for _, fld := range parent.Fields {
+		if fld == parent.RecordField {
+			if lCol := parentTable.GetColumn(fld.Name); lCol != nil && orgTable.GetColumn(fld.Name) == nil {
+				lNewCol := *lCol
+				orgTable.AddColumn(&lNewCol)
+			}
+			if _, has := tbl.Fields[fld.Name]; !has {
+				lNewFld := *fld
+				lNewFld.member_index = append([]int{index}, fld.member_index...)
+				tbl.RecordField = &lNewFld
+				tbl.Fields[fld.Name] = &lNewFld
 			}
+			continue
 		}
-	*/
+
+		// 只继承存储于父表或父表经 Join 读取的字段
+		if _, has := tbl.Fields[fld.Name]; has || fld.foreign_field || !(fld.Store || fld.IsRelatedPath()) {
+			continue
+		}
+
+		lTopest := parent.Name
+		if rel, has := parent.InheritFields[fld.Name]; has {
+			lTopest = rel.RelateTopestTable
+		}
+
+		lNewFld := *fld //复制关联字段
+		lNewFld.member_index = append([]int{index}, fld.member_index...)
+		lNewFld.Related = m2o + "." + fld.Name
+		lNewFld.Store = false
+		tbl.Fields[fld.Name] = &lNewFld
+		tbl.InheritFields[fld.Name] = NewRelateField(fld.Name, parent.Name, m2o, fld, lTopest)
+	}
+}
+
+// 继承的字段 old 是否被父表字段 fld 替换
+// 与 Go 的嵌入规则相同 嵌入层次浅的字段优先 同层次时先声明的成员优先
+func inheritedDeeper(old, fld *TField) bool {
+	return len(old.member_index) > 1 && len(old.member_index) > len(fld.member_index)+1
 }
 
-func (self *TOrm) tag_one2many(fld *TField, arg ...string) { //comodel_name string, inverse_name string
+// 设置委托继承的 many2one 字段 Model 中未声明时自动添加
+func (self *TOrm) delegateField(tbl *TTable, orgTable *core.Table, colMap map[string]*core.Column, name string, parent string) {
+	lField := tbl.Fields[name]
+	if lField == nil || lField.IsRelatedPath() {
+		lField = NewField()
+		lField.Name = name
+		tbl.Fields[name] = lField
+	}
+
+	lCol := orgTable.GetColumn(name)
+	if lCol == nil {
+		if lCol = colMap[name]; lCol == nil {
+			lCol = core.NewColumn(name, "", core.SQLType{core.BigInt, 0, 0}, 0, 0, false)
+		}
+		orgTable.AddColumn(lCol)
+	}
+	lCol.Nullable = false
+
+	self.tag_many2one(lField, parent)
+	lField.Required = true
+	lField.Store = true
+	lField.ondelete = "cascade"
+}
+
+func (self *TOrm) tag_one2many(fld *TField, arg ...string) error { //comodel_name string, inverse_name string
 	fld.read = false
 	fld.write = false
-	if len(arg) > 1 {
-		fld.comodel_name = utils.DotCasedName(utils.TitleCasedName(arg[0])) //目标表
-		fld.cokey_field_name = utils.SnakeCasedName(arg[1])                 //目标表关键字段
-
-		fld.Relation = fld.comodel_name
-		fld._type = "one2many" //TODO 剔除掉
-		fld.Type = "one2many"
-	} else {
-		logger.Panic("One2Many field " + fld.Name + "'s Args can no be blank!")
+	fld.Store = false // 无数据库字段
+	fld.Searchable = false
+	if len(arg) < 2 {
+		return fmt.Errorf("one2many needs a comodel and an inverse field, e.g. one2many(res.partner, parent_id)")
 	}
+
+	fld.comodel_name = utils.DotCasedName(utils.TitleCasedName(arg[0])) //目标表
+	fld.cokey_field_name = utils.SnakeCasedName(arg[1])                 //目标表关键字段
+
+	fld.Relation = fld.comodel_name
+	fld._type = "one2many" //TODO 剔除掉
+	fld.Type = "one2many"
+	return nil
 }
 
-func (self *TOrm) tag_many2one(fld *TField, arg ...string) { //comodel_name string
+func (self *TOrm) tag_many2one(fld *TField, arg ...string) error { //comodel_name string
 	fld.read = false
 	fld.write = true
-	if len(arg) > 0 {
-		fld.comodel_name = utils.DotCasedName(utils.TitleCasedName(arg[0])) //目标表
-		fld.Relation = fld.comodel_name
-		fld._type = "many2one" //TODO 剔除掉
-		fld.Type = "many2one"
-	} else {
-		logger.Panic("Many2One field ", fld.Name, "'s Args can no be blank!")
+	if len(arg) < 1 {
+		return fmt.Errorf("many2one needs a comodel, e.g. many2one(res.partner)")
 	}
 
+	fld.comodel_name = utils.DotCasedName(utils.TitleCasedName(arg[0])) //目标表
+	fld.Relation = fld.comodel_name
+	fld._type = "many2one" //TODO 剔除掉
+	fld.Type = "many2one"
+	return nil
 }
 
-func (self *TOrm) tag_many2many(fld *TField, arg ...string) { //comodel_name, relation, key_field1, key_field2 string
+func (self *TOrm) tag_many2many(fld *TField, arg ...string) error { //comodel_name, relation, key_field1, key_field2 string
 	fld.read = false
 	fld.write = false
-	if len(arg) > 3 {
-		fld.comodel_name = utils.DotCasedName(utils.TitleCasedName(arg[0]))  //目标表
-		fld.relmodel_name = utils.DotCasedName(utils.TitleCasedName(arg[1])) //提供目标表格关系的表
-		fld.cokey_field_name = utils.SnakeCasedName(arg[2])                  //目标表关键字段
-		fld.relkey_field_name = utils.SnakeCasedName(arg[3])                 // 关系表关键字段
-		fld.Relation = fld.comodel_name
-		fld._type = "many2many" //TODO 剔除掉
-		fld.Type = "many2many"
-	} else {
-		logger.Panic("Many2Many field ", fld.Name, "'s Args can no be blank!")
+	fld.Store = false // 关系存储于关系表
+	fld.Searchable = false
+	if len(arg) < 4 {
+		return fmt.Errorf("many2many needs a comodel, a relation table and two key fields, e.g. many2many(res.groups, res.groups.users.rel, uid, gid)")
 	}
 
+	fld.comodel_name = utils.DotCasedName(utils.TitleCasedName(arg[0]))  //目标表
+	fld.relmodel_name = utils.DotCasedName(utils.TitleCasedName(arg[1])) //提供目标表格关系的表
+	fld.cokey_field_name = utils.SnakeCasedName(arg[2])                  //目标表关键字段
+	fld.relkey_field_name = utils.SnakeCasedName(arg[3])                 // 关系表关键字段
+	fld.Relation = fld.comodel_name
+	fld._type = "many2many" //TODO 剔除掉
+	fld.Type = "many2many"
+	return nil
 }
 
 // TODO 方法可以是任何大小写 参考https://github.com/alangpierce/go-forceexport
-// 所有的selection 函数必须是大写并返回map[string]interface{}格式
-func (self *TOrm) tag_selection(modelType reflect.Value, fld *TField, arg ...string) { //comodel_name, relation, key_field1, key_field2 string
-	if len(arg) > 0 {
-		lStr := strings.Trim(arg[0], "'")
-		lStr = strings.Replace(lStr, "''", "'", -1)
-		if m := modelType.MethodByName(lStr); m.IsValid() {
-			results := m.Call([]reflect.Value{modelType}) //
-			if len(results) == 1 {
-				fld.Selection, _ = results[0].Interface().(map[string]interface{})
-			}
-		} else {
-			err := json.Unmarshal([]byte(lStr), &fld.Selection)
-			logger.LogErr(err)
+// selection 方法必须是大写 See callSelection()
+func (self *TOrm) tag_selection(modelType reflect.Value, fld *TField, arg ...string) error { //comodel_name, relation, key_field1, key_field2 string
+	if len(arg) < 1 {
+		return fmt.Errorf("selection needs a JSON array, a JSON object or a method name")
+	}
+
+	lStr := arg[0]
+	lSelection, lIsMethod, err := callSelection(modelType, lStr)
+	if err != nil {
+		return err
+	}
+
+	if !lIsMethod {
+		if lSelection, err = parseSelection(lStr); err != nil {
+			return fmt.Errorf("selection %s is neither a method nor JSON: %v", lStr, err)
 		}
-		fld._type = "selection" //TODO 剔除掉
-		fld.Type = "selection"
-	} else {
-		logger.Panic("selection field ", fld.Name, "'s Args can no be blank!")
 	}
+	fld.Selection = lSelection
+
+	fld._type = "selection" //TODO 剔除掉
+	fld.Type = "selection"
+	return nil
+}
+
+// compute(方法名) 计算字段 方法签名为 func(rec *TRecordSet) interface{}
+// 未指定 store 的计算字段不存储于数据库 读取时计算
+func (self *TOrm) tag_function(modelType reflect.Value, fld *TField, arg ...string) error {
+	if len(arg) < 1 {
+		return fmt.Errorf("compute needs a method name")
+	}
+
+	lName := arg[0]
+	if err := checkMethod(modelType.Type(), "compute", lName); err != nil {
+		return err
+	}
+	fld.compute = lName
+	return nil
 }
 
-func (self *TOrm) tag_function(fld *TField, arg ...string) {
+// inverse(方法名) 计算字段的反向方法
+// 方法签名为 func(rec *TRecordSet, value interface{}) map[string]interface{} 返回需要写入的存储字段
+func (self *TOrm) tag_inverse(modelType reflect.Value, fld *TField, arg ...string) error {
+	if len(arg) < 1 {
+		return fmt.Errorf("inverse needs a method name")
+	}
 
+	lName := arg[0]
+	if err := checkMethod(modelType.Type(), "inverse", lName); err != nil {
+		return err
+	}
+	fld._fnct_inv = lName
+	return nil
 }
 
 // 重新映射Model 获取字段信息
 // TODO 优化速度逻辑
 
 //func (self *TOrm) mapType(v reflect.Value, t *core.Table) *core.Table {
-func (self *TOrm) mapType(model interface{}, t *core.Table) (lTable *TTable, lOrgTable *core.Table) {
+// 返回所有定义错误 See TModelErrors
+func (self *TOrm) mapType(model interface{}, t *core.Table) (lTable *TTable, lOrgTable *core.Table, err error) {
 	v := reflect.Indirect(reflect.ValueOf(model))
 	lType := v.Type()
 
-	// 确认信ORM包含该表 以便更新
-	lTable = self.Tables[lType]
-	if lTable == nil {
-		lTable = NewTable(t.Name, lType)
-	}
+	// 总是新建 已注册的表在计划执行后才被替换 See registerModels()
+	lTable = NewTable(t.Name, lType)
 
 	// 创建一个原始ORM表
 	lOrgTable = core.NewTable(t.Name, t.Type)
@@ -379,16 +555,18 @@ func (self *TOrm) mapType(model interface{}, t *core.Table) (lTable *TTable, lOr
 	}
 	//<<<<<<<<<
 	lRelateFields := make([]string, 0)
+	lDelegates := make(map[string]string) // 委托继承 many2one 字段 -> 父表
+	lColumns := make(map[string]string)   // 数据库字段名 -> 成员名
+	lErrs := make(TModelErrors, 0)
 	for i := 0; i < lType.NumField(); i++ {
 		lMemberName = lType.Field(i).Name
 		lFieldName = utils.SnakeCasedName(lMemberName)
-		lFieldValue := v.Field(i)
 		//		lFieldType := lType.Field(i).Type
 		lFieldTag := lType.Field(i).Tag
 
 		// 忽略无Tag的匿名继承结构
 		//logger.Dbg(lType.Field(i).Name, lFieldType.Name(), lTag)
-		if lType.Field(i).Name == lType.Field(i).Type.Name() && lFieldTag == "" {
+		if (lType.Field(i).Anonymous || lType.Field(i).Name == lType.Field(i).Type.Name()) && lFieldTag == "" {
 			continue
 		}
 
@@ -402,7 +580,14 @@ func (self *TOrm) mapType(model interface{}, t *core.Table) (lTable *TTable, lOr
 		} else {
 			//<** 如果是继承的字段则替换
 			//原因：Join时导致Select到的字段为关联表字段而获取不到原本Model的字段如Id,write_time...
-			if lField.foreign_field {
+			// 本表字段优先于父表字段
+			if lField.foreign_field || len(lField.member_index) > 1 {
+				lField = NewField()
+			}
+
+			// 委托继承的父表字段被本表字段替换
+			if _, has = lTable.InheritFields[lFieldName]; has && lField.IsRelatedPath() {
+				delete(lTable.InheritFields, lFieldName)
 				lField = NewField()
 			}
 		}
@@ -412,6 +597,7 @@ func (self *TOrm) mapType(model interface{}, t *core.Table) (lTable *TTable, lOr
 
 		// 默认赋值
 		lField.Name = lFieldName
+		lField.member_index = []int{i}
 		lField._symbol_c = `%s`         // # 修改字段格式化
 		lField._symbol_f = _FieldFormat //
 
@@ -434,31 +620,22 @@ func (self *TOrm) mapType(model interface{}, t *core.Table) (lTable *TTable, lOr
 		// 解析并变更默认值
 		//logger.Dbg("ccc", lFieldName, lCol, lFieldTag)
 		var (
-			lTag    []string
-			lStr    string
-			lLen    int
-			lIgonre bool
+			lTag      []string
+			lIgonre   bool
+			lStoreTag bool   // 明确指定了 store
+			lDelegate string // 委托继承的 many2one 字段
 		)
-		lTags := splitTag(lFieldTag.Get("field"))
-		for _, key := range lTags {
-			//>>>>>>>>>
-			//以下代码是为了避免XORM解析不规则字符串为字段名提醒使用者规范Tag数据格式应该注意不用空格
-			lTag = parseTag(key)
-			lStr = strings.Replace(key, lTag[0], "", 1) // 去掉Tag Item
-			lStr = strings.TrimLeft(lStr, "(")
-			lStr = strings.TrimRight(lStr, ")")
-			lLen = len(lStr)
-			if lLen > 0 {
-				if strings.Index(lStr, " ") != -1 {
-					if !strings.HasPrefix(lStr, "'") &&
-						!strings.HasSuffix(lStr, "'") {
-						logger.Logger.Error("Model %s's %s tags could no including space ' ' in brackets value whicth it not 'String' type.", t.Name, strings.ToUpper(lFieldName))
-						panic("")
-					}
-				}
-			}
+		lTags, lErr := parseFieldTag(lFieldTag.Get("field"))
+		if lErr != nil {
+			lTagErr := lErr.(*TTagError)
+			lTagErr.Model = t.Name
+			lTagErr.Member = lMemberName
+			lErrs.merge(t.Name, lTagErr)
+			continue
+		}
+		for _, item := range lTags {
+			lTag = append([]string{item.Name}, item.Args...)
 			lIgonre = false
-			//<<<<<<<<<<<
 			//logger.Dbg("tag:", key, lTag)
 			// 原始ORM映射,理论上无需再次解析只需修改Tag和扩展后的一致即可
 			switch strings.ToLower(lTag[0]) {
@@ -467,9 +644,18 @@ func (self *TOrm) mapType(model interface{}, t *core.Table) (lTable *TTable, lOr
 				break
 			case "--": // 只映射不修改进数据库
 				break
-			case "extends", "relate": // 忽略某些继承者成员
+			case "extends", "relate", "delegate": // 忽略某些继承者成员
 				is_relate := strings.ToLower(lTag[0]) == "relate"
 
+				// delegate(partner_id) 委托继承 父表字段存储于父表 通过 many2one 字段关联
+				// extends 的父表字段存储于本表 须明确使用 delegate 才委托继承
+				if strings.ToLower(lTag[0]) == "delegate" {
+					lDelegate = lFieldName + "_id"
+					if len(lTag) > 1 {
+						lDelegate = utils.SnakeCasedName(lTag[1])
+					}
+				}
+
 				if is_relate {
 					if len(lTag) > 1 {
 						lRelFldName := utils.SnakeCasedName(lTag[1])
@@ -482,25 +668,41 @@ func (self *TOrm) mapType(model interface{}, t *core.Table) (lTable *TTable, lOr
 					//  extends
 				}
 
-				switch lFieldValue.Kind() {
-				case reflect.Ptr:
-					logger.Logger.Error("field:%s as pointer is not supported!", lFieldName)
-					break
+				// 指针成员与值成员相同 映射其类型的零值
+				lParentType := lType.Field(i).Type
+				if lParentType.Kind() == reflect.Ptr {
+					lParentType = lParentType.Elem()
+				}
+
+				switch lParentType.Kind() {
+				default:
+					lErrs.add(t.Name, lFieldName, "%s member must be a struct or a pointer to struct", lTag[0])
 				case reflect.Struct:
 					var (
 						newParentTable *TTable // 新ORM的Table
 						parentTable    *core.Table
 					)
 
-					parentTable = self.TableInfo(lFieldValue.Interface())
-					newParentTable, parentTable = self.mapType(lFieldValue.Interface(), parentTable)
-					//logger.Dbg("parent", parentTable, parentTable.Name, lFieldValue.Interface())
+					lParent := reflect.New(lParentType).Interface()
+					parentTable = self.TableInfo(lParent)
+					newParentTable, parentTable, lErr = self.mapType(lParent, parentTable)
+					if lErr != nil {
+						lErrs.merge(t.Name, lErr)
+						break
+					}
+					if lDelegate != "" {
+						lDelegates[lDelegate] = newParentTable.Name
+						self.delegateFields(lTable, lOrgTable, newParentTable, parentTable, lDelegate, i)
+						break
+					}
+					//logger.Dbg("parent", parentTable, parentTable.Name, lParent)
 					//var lNewFld *TField
 					for _, fld := range newParentTable.Fields {
 						//d待续
-						if _, has := lTable.Fields[fld.Name]; !has {
+						if lOld, has := lTable.Fields[fld.Name]; !has || inheritedDeeper(lOld, fld) {
 							//lNewFld = new(TField)
 							lNewFld := *fld //复制关联字段
+							lNewFld.member_index = append([]int{i}, fld.member_index...)
 							logger.Dbg("FFF", newParentTable.Name, fld, fld.Name, lNewFld)
 
 							if is_relate {
@@ -520,9 +722,7 @@ func (self *TOrm) mapType(model interface{}, t *core.Table) (lTable *TTable, lOr
 								logger.Dbg("RecordField", fld.Name)
 							}
 
-							if _, has := lTable.Fields[fld.Name]; !has {
-								lTable.Fields[fld.Name] = &lNewFld
-							}
+							lTable.Fields[fld.Name] = &lNewFld
 
 							// 记录继承字段
 							//lModelName := utils.TitleCasedName(utils.DotCasedName(lFieldTable.Name))
@@ -582,6 +782,9 @@ func (self *TOrm) mapType(model interface{}, t *core.Table) (lTable *TTable, lOr
 					}*/
 				fallthrough // 继续其他Case
 			case "inherits": // postgres 的继承功能
+				if lDelegate != "" {
+					break
+				}
 				if !utils.InStrings(lFieldName, lTable.Inherits...) {
 					lTable.Inherits = append(lTable.Inherits, lFieldName)
 				}
@@ -589,15 +792,22 @@ func (self *TOrm) mapType(model interface{}, t *core.Table) (lTable *TTable, lOr
 				// 字段其他参数映射
 			case "inherited": // 该字段继承来自X表X字段名称 //name = openerp.fields.Char(related='partner_id.name', inherited=True)
 				// inherited(partner_id.name)
-				//TODO 实现
-				break
+				if len(lTag) > 1 {
+					lField.Related = lTag[1]
+				}
 			case "_relate": // 关联某表
 				if len(lTag) > 1 {
 					logger.Dbg("relate to:", utils.DotCasedName(lMemberName), utils.SnakeCasedName(lTag[1]))
 					// 现在成员名是关联的Model名,Tag 为关联的字段
 					lTable.Relations[utils.DotCasedName(lMemberName)] = utils.SnakeCasedName(lTag[1])
 				}
-			case "related": //废弃 该字段使Model继承父级依据 See SetupModels()
+			case "related": // related(partner_id.name) 经 many2one 字段关联的字段
+				if len(lTag) > 1 && strings.Contains(lTag[1], ".") {
+					lField.Related = lTag[1]
+					break
+				}
+
+				//废弃 该字段使Model继承父级依据 See SetupModels()
 				//  更新关联字段名称
 				lField.related = true
 				if len(lTag) > 1 {
@@ -617,6 +827,9 @@ func (self *TOrm) mapType(model interface{}, t *core.Table) (lTable *TTable, lOr
 				if len(lTag) > 1 {
 					logger.Dbg("default:", lTag[1])
 					lCol.Default = lTag[1]
+					if item.Quoted[0] { // 字符串默认值
+						lCol.Default = "'" + strings.Replace(lTag[1], "'", "''", -1) + "'"
+					}
 				}
 			case "created":
 				lCol.IsCreated = true
@@ -688,27 +901,49 @@ func (self *TOrm) mapType(model interface{}, t *core.Table) (lTable *TTable, lOr
 				// 不直接指定 采用以下tag写法
 				// field:"one2many() int()"
 				//lField.initOne2Many(lTag[1:]...)
-				self.tag_one2many(lField, lTag[1:]...)
+				if lErr = self.tag_one2many(lField, lTag[1:]...); lErr != nil {
+					lErrs.add(t.Name, lFieldName, "%v", lErr)
+				}
 			case "many2one": //用户有多少公司
 				// 不直接指定 采用以下tag写法
 				// field:"many2one() int()"
 				//col.SQLType = core.Type2SQLType(lFieldType)
 				//lField.initMany2One(lTag[1:]...)
-				self.tag_many2one(lField, lTag[1:]...)
+				if lErr = self.tag_many2one(lField, lTag[1:]...); lErr != nil {
+					lErrs.add(t.Name, lFieldName, "%v", lErr)
+				}
 			case "many2many":
 				// 不直接指定 采用以下tag写法
 				// field:"many2many() int()"
 				//lField.initMany2Many(lTag[1:]...)
-				self.tag_many2many(lField, lTag[1:]...)
+				if lErr = self.tag_many2many(lField, lTag[1:]...); lErr != nil {
+					lErrs.add(t.Name, lFieldName, "%v", lErr)
+				}
 			case "selection":
 				//fields.Selection([('linear', 'Linear'), ('degressive', 'Degressive')]), string='Computation Method'
 				//fields.Selection(['linear', 'Linear','degressive', 'Degressive']), string='Computation Method'
 				lField.Type = "selection"
 				//lField.initSelection(lTag[1:]...)
-				self.tag_selection(v, lField, lTag[1:]...)
-			case "function": // fields.function(_get_full_name
+				if lErr = self.tag_selection(v, lField, lTag[1:]...); lErr != nil {
+					lErrs.add(t.Name, lFieldName, "%v", lErr)
+				}
+			case "function", "compute": // compute(_compute_full_name)
 				//lField.Type = "function" function 是未定义字段
-				self.tag_function(lField, lTag[1:]...)
+				if lErr = self.tag_function(v, lField, lTag[1:]...); lErr != nil {
+					lErrs.add(t.Name, lFieldName, "%v", lErr)
+				}
+			case "inverse": // inverse(_inverse_full_name)
+				if lErr = self.tag_inverse(v, lField, lTag[1:]...); lErr != nil {
+					lErrs.add(t.Name, lFieldName, "%v", lErr)
+				}
+			case "depends": // depends(name,partner_id.name)
+				lField.Depends = append(lField.Depends, lTag[1:]...)
+			case "store": // store(true)
+				lStoreTag = true
+				lField.Store = true
+				if len(lTag) > 1 {
+					lField.Store = utils.StrToBool(lTag[1])
+				}
 			case "name": // title of the field
 				if len(lTag) > 1 {
 					lNewName := lTag[1]
@@ -726,16 +961,17 @@ func (self *TOrm) mapType(model interface{}, t *core.Table) (lTable *TTable, lOr
 					lCol.Name = lNewName
 					lField.Name = lNewName
 				}
+			case "oldname": // oldname(previous_name) 字段原名称 同步时重命名
+				if len(lTag) > 1 {
+					lField.oldname = utils.SnakeCasedName(lTag[1])
+				}
 			case "string": // title of the field
 				if len(lTag) > 1 {
-					lField.String = strings.Trim(lTag[1], "'")
-					lField.String = strings.Replace(lField.String, "''", "'", -1)
+					lField.String = lTag[1]
 				}
 			case "help":
 				if len(lTag) > 1 {
-					lField.Help = strings.Trim(lTag[1], "'")
-					lField.String = strings.Replace(lField.String, "''", "'", -1)
-					//logger.Dbg(lField.Help)
+					lField.Help = lTag[1]
 				}
 			case "required": // required(true)
 				lField.Required = true
@@ -758,7 +994,12 @@ func (self *TOrm) mapType(model interface{}, t *core.Table) (lTable *TTable, lOr
 					lCol.Length = int(utils.StrToInt64(lTag[1]))
 					lField.Size = utils.StrToInt64(lTag[1])
 				}
-			case "ondelete": // ondelete(restrict) for m2m
+			case "enforce": // enforce(check|enum) 选择字段的数据库约束
+				lField.enforce = "check"
+				if len(lTag) > 1 {
+					lField.enforce = strings.ToLower(lTag[1])
+				}
+			case "ondelete": // ondelete(restrict|cascade|set null) for m2o
 				if len(lTag) > 1 {
 					lField.ondelete = lTag[1]
 				}
@@ -771,12 +1012,20 @@ func (self *TOrm) mapType(model interface{}, t *core.Table) (lTable *TTable, lOr
 				break
 			case "read":
 				break
+			case "searchable": // searchable(false) 禁止在Domain中使用
+				lField.Searchable = true
+				if len(lTag) > 1 {
+					lField.Searchable = utils.StrToBool(lTag[1])
+				}
 			case "selectable":
 			case "group_operator":
 			case "groups": // groups='base.group_user' CSV list of ext IDs of groups
 			case "deprecated": // # Optional deprecation warning
 			default:
-				logger.Dbg("unknown tag ", key)
+				// 拼写错误的 Tag 如 requierd 作为定义错误 xorm 的 Tag 及数据库类型由 xorm 处理
+				if !isXormTag(item.Name) {
+					lErrs.add(t.Name, lFieldName, "unknown tag %s at column %d", item.Name, item.Pos)
+				}
 			}
 		}
 
@@ -786,6 +1035,30 @@ func (self *TOrm) mapType(model interface{}, t *core.Table) (lTable *TTable, lOr
 			}
 		}
 
+		//  更新关联字段名称
+		if lField.oldname != "" {
+			for tbl, fld := range lTable.Relations {
+				if fld == lField.oldname {
+					lTable.Relations[tbl] = lField.Name
+				}
+			}
+		}
+
+		// 关联字段不存储 读取时经 Join 获取
+		if lField.Related != "" {
+			lField.Store = false
+		}
+
+		// 计算字段默认不存储 无反向方法时只读
+		if lField.compute != "" {
+			if !lStoreTag {
+				lField.Store = false
+			}
+			if lField._fnct_inv == nil {
+				lField.Readonly = true
+			}
+		}
+
 		// 设置Help
 		if lField.String == "" {
 			lField.String = lField.Name
@@ -794,13 +1067,19 @@ func (self *TOrm) mapType(model interface{}, t *core.Table) (lTable *TTable, lOr
 		if lField.Help == "" && lField.String != "" {
 			lField.Help = lField.String
 		}
-		// 是否继承关联表所有字段
-		if lField.related {
+		// 关联字段继承源字段属性
+		if lField.IsRelatedPath() {
 			self.tag_related(lTable, lField)
 		}
 
 		// 通过条件过滤不学要的原始字段
-		if !lIgonre && lCol.SQLType.Name != "" && lField._type != "many2many" {
+		if !lIgonre && lCol.SQLType.Name != "" && lField.Store {
+			// name(...) 重命名后可能与其他成员的字段同名
+			if lOther, has := lColumns[lCol.Name]; has {
+				lErrs.add(t.Name, lFieldName, "column %s is also used by member %s", lCol.Name, lOther)
+				continue
+			}
+			lColumns[lCol.Name] = lMemberName
 			lOrgTable.AddColumn(lCol)
 		}
 
@@ -817,6 +1096,11 @@ func (self *TOrm) mapType(model interface{}, t *core.Table) (lTable *TTable, lOr
 			fld.related = true
 		}
 	}
+
+	// 委托继承的 many2one 字段 必填且随父记录删除
+	for name, parent := range lDelegates {
+		self.delegateField(lTable, lOrgTable, lColMap, name, parent)
+	}
 	// 创建ORM table
 	/*
 		// 遍历获得原始字段 例如：Extends其他表的字段
@@ -840,272 +1124,54 @@ func (self *TOrm) mapType(model interface{}, t *core.Table) (lTable *TTable, lOr
 	//self.nameIndex[t.Name] = lTable //添加表名称索引
 	logger.Dbg("maptype", lTable, lOrgTable, t.Name)
 	//self.Engine.Tables[lType] = lOrgTable // 更新原始ORM Table
-	return
+	return lTable, lOrgTable, lErrs.err()
 }
 
 //# 插入一个新的Table并创建
 // 同步更新Model 并返回同步后表 <字段>
+// 定义错误为 TModelErrors 关联的 Model 可稍后同步 不检查其是否存在 See SyncModels()
 func (self *TOrm) SyncModel(model interface{}) (table *TTable, err error) {
-	sess := self.NewSession()
-	defer func() {
-		sess.Close()
-		self.ShowSQL(TestShowSql) // 恢复
-	}()
+	lTables, err := self.syncModels([]interface{}{model}, false)
+	if err != nil {
+		return nil, err
+	}
+	return lTables[0], nil
+}
+
+// 同步一批 Model 并返回同步后的表
+// 所有 Model 的定义错误合并为一个 TModelErrors 关联的 Model 须在本批中或已同步
+func (self *TOrm) SyncModels(models ...interface{}) ([]*TTable, error) {
+	return self.syncModels(models, true)
+}
+
+func (self *TOrm) syncModels(models []interface{}, comodels bool) (tables []*TTable, err error) {
+	defer self.ShowSQL(self.config.ShowSql) // 恢复
 
 	// 同步
 	self.ShowSQL(false) // 关闭SQL显示
-	//err = self.Sync2(model)
 
-	// 原始库解析Model
-	lValue := reflect.Indirect(reflect.ValueOf(model))
-	lType := lValue.Type()
-	lTable := self.TableInfo(model)
-	lTables, err := self.DBMetas() //获取原始ORM所有表
-	if logger.LogErr(err) {
+	// 生成并执行同步计划 See PlanSync()
+	lPlan, err := self.planSync(models, comodels)
+	if err != nil {
 		return nil, err
 	}
 
-	// find exsit table
-	var lOrgTable *core.Table
-	for _, tb := range lTables {
-		if strings.ToLower(tb.Name) == strings.ToLower(lTable.Name) {
-			lOrgTable = tb
-			break
-		}
+	for _, warn := range lPlan.Warnings {
+		self.Logger().Warnf("%s", warn)
 	}
-
-	// 重新Mapping新规则
-	//logger.Dbg("SyncModel1", len(lTables), lOrgTable, lTable.Name)
-	var NewTable *TTable
-	NewTable, lTable = self.mapType(model, lTable) // 更新自定义后的Table
-	// 保存会列表
-	self.Tables[lType] = NewTable
-	self.nameIndex[NewTable.Name] = NewTable //添加表名称索引
-	self.Engine.Tables[lType] = lTable       // 更新原始ORM Table
-	//logger.Dbg("maptype", lTable, lOrgTable, t.Name)
-
-	// 如果不存在 创建新的
-	if lOrgTable == nil {
-		var (
-		//lType  reflect.Type
-		//lValue reflect.Value
-		//lName  string
-		)
-
-		//bean := self.mapType(model, lTable) //self.mapType(lValue, lTable)
-		//logger.Dbg("SyncModel2", bean)
-		err = self.StoreEngine(sess.Statement.StoreEngine).CreateTable(lTable)
-		if err != nil {
-			return nil, err
-		}
-
-		err = self.createUniques(lTable)
-		if err != nil {
-			return nil, err
-		}
-
-		err = self.createIndexes(lTable)
-		if err != nil {
-			return nil, err
-		}
-	} else {
-
-		//lTable := self.mapType(model, lTable) //self.mapType(lValue, lTable)
-		//self.Engine.Tables[lTable.Type] = lTable // 更新原始ORM Table
-
-		// 添加新的Column
-		for _, col := range lTable.Columns() {
-			var OrgCol *core.Column
-			for _, col2 := range lOrgTable.Columns() {
-				if strings.ToLower(col.Name) == strings.ToLower(col2.Name) {
-					OrgCol = col2
-					break
-				}
-			}
-
-			//logger.Dbg("SyncModel1 OrgCol", OrgCol, col.Name)
-
-			if OrgCol != nil {
-				expectedType := self.Dialect().SqlType(col)
-				curType := self.Dialect().SqlType(OrgCol)
-				if expectedType != curType {
-					if expectedType == core.Text &&
-						strings.HasPrefix(curType, core.Varchar) {
-						// currently only support mysql & postgres
-						if self.Dialect().DBType() == core.MYSQL ||
-							self.Dialect().DBType() == core.POSTGRES {
-							self.Logger().Warnf("Table %s column %s change type from %s to %s\n",
-								lTable.Name, col.Name, curType, expectedType)
-							_, err = self.Exec(self.Dialect().ModifyColumnSql(lTable.Name, col))
-						} else {
-							self.Logger().Warnf("Table %s column %s db type is %s, struct type is %s\n",
-								lTable.Name, col.Name, curType, expectedType)
-						}
-					} else if strings.HasPrefix(curType, core.Varchar) && strings.HasPrefix(expectedType, core.Varchar) {
-						if self.Dialect().DBType() == core.MYSQL {
-							if OrgCol.Length < col.Length {
-								self.Logger().Infof("Table %s column %s change type from varchar(%d) to varchar(%d)\n",
-									lTable.Name, col.Name, OrgCol.Length, col.Length)
-								_, err = self.Exec(self.Dialect().ModifyColumnSql(lTable.Name, col))
-							}
-						}
-					} else {
-						self.Logger().Warnf("Table %s column %s db type is %s, struct type is %s",
-							lTable.Name, col.Name, curType, expectedType)
-					}
-				} else if expectedType == core.Varchar {
-					if self.Dialect().DBType() == core.MYSQL {
-						if OrgCol.Length < col.Length {
-							self.Logger().Infof("Table %s column %s change type from varchar(%d) to varchar(%d)\n",
-								lTable.Name, col.Name, OrgCol.Length, col.Length)
-							_, err = self.Exec(self.Dialect().ModifyColumnSql(lTable.Name, col))
-						}
-					}
-				}
-				if col.Default != OrgCol.Default {
-					self.Logger().Warnf("Table %s Column %s db default is %s, struct default is %s",
-						lTable.Name, col.Name, OrgCol.Default, col.Default)
-				}
-				if col.Nullable != OrgCol.Nullable {
-					self.Logger().Warnf("Table %s Column %s db nullable is %v, struct nullable is %v",
-						lTable.Name, col.Name, OrgCol.Nullable, col.Nullable)
-				}
-			} else {
-				session := self.NewSession()
-				session.Statement.RefTable = lTable
-				defer session.Close()
-				err = session.addColumn(col.Name)
-			}
-			if err != nil {
-				return nil, err
-			}
-		}
-
-		var foundIndexNames = make(map[string]bool)
-		var addedNames = make(map[string]*core.Index)
-		// 变更索引
-		for name, index := range lTable.Indexes {
-			var oriIndex *core.Index
-			for name2, index2 := range lOrgTable.Indexes {
-				if index.Equal(index2) {
-					oriIndex = index2
-					foundIndexNames[name2] = true
-					logger.Dbg("rrrrrr", name, index, oriIndex.Type, index.Type)
-					break
-				}
-			}
-
-			if oriIndex != nil {
-				if oriIndex.Type != index.Type {
-					sql := self.Dialect().DropIndexSql(lTable.Name, oriIndex)
-					_, err = self.Exec(sql)
-					if err != nil {
-						//return nil, err
-						logger.Logger.Error("func SyncModel error#%s:%s", sql, err.Error())
-					}
-					oriIndex = nil
-				}
-			}
-
-			if oriIndex == nil {
-				addedNames[name] = index
-			}
-		}
-
-		for name2, index2 := range lOrgTable.Indexes {
-			if _, ok := foundIndexNames[name2]; !ok {
-				sql := self.Dialect().DropIndexSql(lTable.Name, index2)
-				_, err = self.Exec(sql)
-				if err != nil {
-					logger.Logger.Error("func SyncModel error#%s:%s", sql, err.Error())
-					//return nil, err
-				}
-			}
-		}
-
-		// 唯一键
-		for name, index := range addedNames {
-			if index.Type == core.UniqueType {
-				session := self.NewSession()
-				session.Statement.RefTable = lTable
-				defer session.Close()
-				err = session.addUnique(lTable.Name, name)
-			} else if index.Type == core.IndexType {
-				session := self.NewSession()
-				session.Statement.RefTable = lTable
-				defer session.Close()
-				err = session.addIndex(lTable.Name, name)
-			}
-			if err != nil {
-				return nil, err
-			}
-		}
-
+	for _, note := range lPlan.Notes {
+		self.Logger().Infof("%s\n", note)
 	}
-	/*  // 验证Table完整性
-	for _, table := range tables {
-		var oriTable *core.Table
-		for _, structTable := range structTables {
-			if equalNoCase(table.Name, structTable.Name) {
-				oriTable = structTable
-				break
-			}
-		}
 
-		if oriTable == nil {
-			//engine.LogWarnf("Table %s has no struct to mapping it", table.Name)
-			continue
-		}
-
-		for _, colName := range table.ColumnsSeq() {
-			if oriTable.GetColumn(colName) == nil {
-				engine.LogWarnf("Table %s has column %s but struct has not related field",
-					table.Name, colName)
-			}
-		}
+	if err = self.ApplyPlan(lPlan); err != nil {
+		return nil, err
 	}
-	*/
-	/*
-		// 创建ORM table
-		var (
-			lType  reflect.Type
-			lValue reflect.Value
-			lName  string
-		)
-		lValue = reflect.Indirect(reflect.ValueOf(model))
-		lType = lValue.Type()
-		lName = utils.SnakeCasedName(utils.Obj2Name(model))
 
-		//utils.Logger.DebugLn("col.SQLType.Name Fields", lType, self.Tables[lType])
-		// 遍历获得字段
-		table = NewTable(lName, lType)
-		if tb, has := self.Engine.Tables[lType]; has {
-
-			for _, col := range tb.Columns() {
-				lField := NewField()
-				lField.Name = col.Name
-
-				lField._type = FieldTypes[col.SQLType.Name]
-				lField.Type = FieldTypes[col.SQLType.Name]
-				//utils.Logger.DebugLn("col.SQLType.Name Fields ", lField.Name, col.SQLType.Name)
-				table.Fields[col.Name] = lField
-
-				if col.IsAutoIncrement && col.IsPrimaryKey {
-					table.RecordField = lField
-				}
-			}
-		}
-
-		//utils.Logger.DebugLn("SyncModels Fields ", table.Fields)
-		self.Tables[lType] = table
-		self.nameIndex[lName] = table
-
-		// 解析自定义字段
-		//self.mapType(lValue)
-	*/
-	table = self.Tables[lTable.Type]
-	logger.Dbg("sycnmodel:", table, lTable.Type)
-	return table, nil
+	for _, model := range models {
+		tables = append(tables, self.TableByType(reflect.Indirect(reflect.ValueOf(model)).Type()))
+	}
+	logger.Dbg("sycnmodel:", tables)
+	return tables, nil
 }
 
 // 执行SQL 并返回主键ID
@@ -1116,10 +1182,13 @@ func (self *TOrm) __SqlInsert(sql string, params ...interface{}) (int64, error)
 	return lRes.LastInsertId()
 }
 
+// 格式化拼接SQL后查询 params 直接填充进SQL 存在注入风险
+// Deprecated: 使用 SqlQueryArgs 绑定参数
 func (self *TOrm) SqlQuery(sql string, params ...string) (ds *TDataSet, err error) {
 	// 无论如何都会返回一个Dataset
 	ds = NewDataSet()
 	ds.KeyField = "id" //设置主键 TODO:可以做到动态
+	ds.Orm = self
 
 	// 转换为[]interface{}
 	t := make([]interface{}, 0)
@@ -1130,32 +1199,17 @@ func (self *TOrm) SqlQuery(sql string, params ...string) (ds *TDataSet, err erro
 	// 填充
 	sql = fmt.Sprintf(sql, t...)
 
-	if TestShowSql {
+	if self.config.ShowSql {
 		logger.Logger.InfoLn("SqlExec:", sql, params)
 	}
 
 	//lRows, err := self.Engine.DB().Query(sql, t...)
-	lRows, err := self.Engine.DB().Query(sql)
+	lRows, err := self.queryRows(sql)
 	if logger.LogErr(err) {
 		return // nil, err
 	}
 
-	defer lRows.Close()
-	for lRows.Next() {
-		tempMap := make(map[string]interface{})
-		err = lRows.ScanMap(&tempMap)
-		if !logger.LogErr(err) {
-			//res = append(res, tempMap)
-			ds.NewRecord(tempMap)
-		}
-
-		//utils.Logger.DebugLn("SqlQuery tempMap :", tempMap)
-	}
-
-	// 打印错误
-	err = lRows.Err()
-	logger.LogErr(err)
-
+	err = rows2DataSet(lRows, ds)
 	return ds, err
 }
 
@@ -1163,7 +1217,7 @@ func (self *TOrm) SqlQuery(sql string, params ...string) (ds *TDataSet, err erro
 func (self *TOrm) SqlExec(sql string, params ...interface{}) (sql.Result, error) {
 	// 组成SQL
 	//sql = fmt.Sprintf(sql, params...)
-	if TestShowSql {
+	if self.config.ShowSql {
 		logger.Logger.InfoLn("SqlExec:", sql, params)
 	}
 
@@ -1175,6 +1229,7 @@ func (self *TOrm) SqlExec(sql string, params ...interface{}) (sql.Result, error)
 	//	utils.Logger.DebugLn("exexex", self.DriverName(), strings.Count(strings.ToLower(sql), "returning") == 1, sql)
 
 	// 过滤Pg 的插入语句
+	sql = stripReturning(self.DriverName(), sql)
 	if self.DriverName() == "postgres" && strings.Count(strings.ToLower(sql), "returning") == 1 {
 		res, err := self.Engine.Query(sql, params...)
 		//utils.Logger.DebugLn("exexex", res, err)
@@ -1313,16 +1368,19 @@ func (self *TOrmSession) Select(str string) *TOrmSession {
 // Method Cols provides some columns to special
 func (self *TOrmSession) Cols(columns ...string) *TOrmSession {
 	self.Statement.Cols(columns...)
+	self.cols = addCols(self.cols, columns)
 	return self
 }
 
 func (self *TOrmSession) AllCols() *TOrmSession {
 	self.Statement.AllCols()
+	self.allCols = true
 	return self
 }
 
 func (self *TOrmSession) MustCols(columns ...string) *TOrmSession {
 	self.Statement.MustCols(columns...)
+	self.mustCols = addCols(self.mustCols, columns)
 	return self
 }
 
@@ -1449,6 +1507,8 @@ func (self *TOrmSession) Having(conditions string) *TOrmSession {
 	return self
 }
 
+// 格式化拼接SQL后查询 params 直接填充进SQL 存在注入风险
+// Deprecated: 使用 QueryArgs 绑定参数
 func (self *TOrmSession) Query(sql string, params ...string) (ds *TDataSet, err error) {
 	// 转换为[]interface{}
 	t := make([]interface{}, 0)
@@ -1461,7 +1521,7 @@ func (self *TOrmSession) Query(sql string, params ...string) (ds *TDataSet, err
 	logger.Dbg("SqlQuery:", sql, params)
 
 	//lRows, err := self.Engine.DB().Query(sql, t...)
-	lRows, err := self.Engine.DB().Query(sql)
+	lRows, err := self.queryRows(sql)
 
 	if logger.LogErr(err) {
 		return nil, err
@@ -1469,23 +1529,9 @@ func (self *TOrmSession) Query(sql string, params ...string) (ds *TDataSet, err
 
 	ds = NewDataSet()
 	ds.KeyField = "id" //设置主键
+	ds.Orm = self.Orm
 
-	defer lRows.Close()
-	for lRows.Next() {
-		tempMap := make(map[string]interface{})
-		err = lRows.ScanMap(&tempMap)
-		if !logger.LogErr(err) {
-			//res = append(res, tempMap)
-			ds.NewRecord(tempMap)
-		}
-
-		//utils.Logger.DebugLn("SqlQuery tempMap :", tempMap)
-	}
-
-	// 打印错误
-	err = lRows.Err()
-	logger.LogErr(err)
-
+	err = rows2DataSet(lRows, ds)
 	return ds, err
 }
 
@@ -1499,14 +1545,11 @@ func (self *TOrmSession) Exec(sql string, params ...interface{}) (sql.Result, er
 	//	if logger.LogErr(err) {
 	//		return 0, err
 	//	}
-	//lTableNaame := self.Statement.TableName()
-	//lTable := self.Orm.TableByName(lTableNaame)
-
-	//self._Validate(lTable)
-	//fmt.Println("_Validate", lTableNaame, lTable)
 
+	// 原始 SQL 不经 _Validate 检查 See Insert() Update()
 	// 过滤Pg 的插入语句
 	logger.Dbg("exexex", self.Orm.DriverName(), strings.Count(strings.ToLower(sql), "returning") == 1, sql)
+	sql = stripReturning(self.Orm.DriverName(), sql)
 	if self.Orm.DriverName() == "postgres" && strings.Count(strings.ToLower(sql), "returning") == 1 {
 
 		res, err := self.Engine.Query(sql, params...)
@@ -1530,9 +1573,27 @@ func (self *TOrmSession) Exec(sql string, params ...interface{}) (sql.Result, er
 func (self *TOrmSession) resetStatement() {
 	if self.AutoResetStatement {
 		self.Statement.Init()
+		self.clearCols()
 	}
 }
 
+// 在事务中执行 fn 会话已在事务中时直接使用该事务
+func (self *TOrmSession) transact(fn func() error) (err error) {
+	if !self.IsAutoCommit {
+		return fn()
+	}
+
+	if err = self.Begin(); err != nil {
+		return err
+	}
+
+	if err = fn(); err != nil {
+		self.Rollback()
+		return err
+	}
+	return self.Commit()
+}
+
 func (self *TOrmSession) addColumn(colName string) error {
 	defer self.resetStatement()
 	if self.IsAutoClose {
@@ -1656,21 +1717,8 @@ func (self *TOrmSession) genUniqueSQL() []string {
 }
 
 func (self *TOrmSession) createOneTable() error {
-	//sqlStr := self.Statement.genCreateTableSQL()
-	sqlStr := self.Engine.Dialect().CreateTableSql(self.Statement.RefTable, self.Statement.AltTableName,
-		self.Statement.StoreEngine, self.Statement.Charset)
-
-	// 实现PG的继承
-	lTable := self.Orm.Tables[self.Statement.RefTable.Type]
-	if lTable != nil {
-		//lInherits := lTable.Inherits
-		if len(lTable.Inherits) > 0 && strings.EqualFold(self.Engine.DriverName(), "postgres") {
-			sqlStr += "INHERITS  ( "
-			sqlStr += strings.Join(lTable.Inherits, ",")
-			sqlStr += " ) "
-		}
-	}
-	logger.Dbg("createOneTable", lTable, sqlStr)
+	sqlStr := self.Orm.createTableSql(self.Statement.RefTable, "")
+	logger.Dbg("createOneTable", sqlStr)
 	_, err := self.Exec(sqlStr)
 	return err
 }
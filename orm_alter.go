@@ -0,0 +1,378 @@
+package orm
+
+/** 字段变更
+同步时修改已有字段的类型 默认值及是否可空 字段以 oldname(原名称) 标记时重命名原字段
+postgres: ALTER COLUMN ... TYPE ... USING / SET|DROP DEFAULT / SET|DROP NOT NULL
+mysql: MODIFY COLUMN
+sqlite: 以新结构重建表并复制数据
+缩小字段类型如 bigint->int varchar(100)->varchar(50) 可能丢失数据 需设置 TOrm.AllowNarrowing
+*/
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	core "github.com/go-xorm/core"
+)
+
+type (
+	// 字段与数据库现有字段的差异
+	columnDiff struct {
+		col, orgCol *core.Column
+		typ         bool // 类型或长度
+		def         bool // 默认值
+		null        bool // 是否可空
+	}
+)
+
+// 类型族及其中的大小 同族中大的类型可容纳小的类型
+var typeRanks = map[string][2]int{
+	core.Bool: {1, 0}, core.Bit: {1, 0}, core.TinyInt: {1, 1}, core.SmallInt: {1, 2}, core.MediumInt: {1, 3},
+	core.Int: {1, 4}, core.Integer: {1, 4}, core.Serial: {1, 4}, core.BigInt: {1, 5}, core.BigSerial: {1, 5},
+	core.Real: {2, 1}, core.Float: {2, 1}, core.Double: {2, 2},
+	core.Decimal: {3, 1}, core.Numeric: {3, 1},
+	core.Char: {4, 1}, core.Varchar: {4, 1}, core.NVarchar: {4, 1}, core.TinyText: {4, 2},
+	core.Text: {4, 3}, core.MediumText: {4, 4}, core.LongText: {4, 5}, core.Clob: {4, 5},
+	core.Date: {5, 1}, core.DateTime: {5, 2}, core.TimeStamp: {5, 2}, core.TimeStampz: {5, 3},
+}
+
+// 比较字段差异 拒绝的变更记为警告 无差异时返回 nil
+func (self *TOrm) diffColumn(plan *TSyncPlan, table string, col, orgCol *core.Column) *columnDiff {
+	lDiff := &columnDiff{col: col, orgCol: orgCol}
+
+	expectedType := self.columnType(col)
+	curType := self.columnType(orgCol)
+	if expectedType != curType {
+		switch {
+		case col.IsPrimaryKey || col.IsAutoIncrement:
+			plan.warn("Table %s column %s db type is %s, struct type is %s: primary key type is not changed",
+				table, col.Name, curType, expectedType)
+		case !self.AllowNarrowing && !widens(orgCol, col):
+			plan.warn("Table %s column %s change type from %s to %s refused: it may lose data, set AllowNarrowing to apply",
+				table, col.Name, curType, expectedType)
+		default:
+			lDiff.typ = true
+		}
+	}
+
+	if !col.IsAutoIncrement && normDefault(col.Default) != normDefault(orgCol.Default) {
+		lDiff.def = true
+	}
+	if !col.IsPrimaryKey && col.Nullable != orgCol.Nullable {
+		lDiff.null = true
+	}
+
+	if !lDiff.typ && !lDiff.def && !lDiff.null {
+		return nil
+	}
+	return lDiff
+}
+
+// 修改字段 postgres 分别修改类型 默认值及是否可空 mysql 以 MODIFY 修改整个字段
+func (self *TOrm) planAlterColumn(plan *TSyncPlan, table *core.Table, diff *columnDiff) {
+	quote := self.Quote
+	col := diff.col
+	lTable, lCol := quote(table.Name), quote(col.Name)
+
+	switch self.Dialect().DBType() {
+	case core.POSTGRES:
+		if diff.typ {
+			lType := self.columnType(col)
+			plan.add(table.Name, fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s TYPE %s USING %s::%s", lTable, lCol, lType, lCol, lType),
+				"column %s change type from %s to %s", col.Name, self.columnType(diff.orgCol), lType)
+		}
+
+		if diff.def {
+			if col.Default == "" {
+				plan.add(table.Name, fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s DROP DEFAULT", lTable, lCol),
+					"column %s drop default %s", col.Name, diff.orgCol.Default)
+			} else {
+				plan.add(table.Name, fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s SET DEFAULT %s", lTable, lCol, col.Default),
+					"column %s change default from %s to %s", col.Name, diff.orgCol.Default, col.Default)
+			}
+		}
+
+		if diff.null {
+			if col.Nullable {
+				plan.add(table.Name, fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s DROP NOT NULL", lTable, lCol),
+					"column %s becomes nullable", col.Name)
+			} else {
+				// 已有的空值以默认值填充
+				if col.Default != "" {
+					plan.add(table.Name, fmt.Sprintf("UPDATE %s SET %s = %s WHERE %s IS NULL", lTable, lCol, col.Default, lCol),
+						"column %s fill nulls with default %s", col.Name, col.Default)
+				}
+				plan.add(table.Name, fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s SET NOT NULL", lTable, lCol),
+					"column %s becomes not null", col.Name)
+			}
+		}
+
+	case core.MYSQL:
+		if diff.null && !col.Nullable && col.Default != "" {
+			plan.add(table.Name, fmt.Sprintf("UPDATE %s SET %s = %s WHERE %s IS NULL", lTable, lCol, col.Default, lCol),
+				"column %s fill nulls with default %s", col.Name, col.Default)
+		}
+		plan.add(table.Name, fmt.Sprintf("ALTER TABLE %s MODIFY COLUMN %s", lTable, col.StringNoPk(self.Dialect())),
+			"column %s change from %s to %s", col.Name, self.describeColumn(diff.orgCol), self.describeColumn(col))
+
+	default:
+		plan.warn("Table %s column %s can not be altered on %s: db is %s, struct is %s",
+			table.Name, col.Name, self.DriverName(), self.describeColumn(diff.orgCol), self.describeColumn(col))
+	}
+}
+
+// sqlite 重建表 新表复制原有数据后替换原表 并重建索引
+func (self *TOrm) planRebuild(plan *TSyncPlan, table, dbTable *core.Table, diffs []*columnDiff) {
+	quote := self.Quote
+	lTmpName := table.Name + "__sync"
+
+	lReasons := make([]string, 0, len(diffs))
+	for _, diff := range diffs {
+		lReasons = append(lReasons, fmt.Sprintf("column %s change from %s to %s",
+			diff.col.Name, self.describeColumn(diff.orgCol), self.describeColumn(diff.col)))
+	}
+	lReason := strings.Join(lReasons, ", ")
+
+	// 删除原表时其他表的外键检查推迟到事务提交 此时已关联到新表
+	plan.add(table.Name, "PRAGMA defer_foreign_keys = ON", "rebuild table: defer foreign keys")
+	plan.add(table.Name, self.createTableSql(table, lTmpName), "rebuild table: %s", lReason)
+
+	// 复制数据 不可空的字段以默认值填充空值
+	lCols := make([]string, 0)
+	lValues := make([]string, 0)
+	for _, col := range table.Columns() {
+		if dbTable.GetColumn(col.Name) == nil {
+			continue
+		}
+
+		lCols = append(lCols, quote(col.Name))
+		if !col.Nullable && col.Default != "" {
+			lValues = append(lValues, fmt.Sprintf("COALESCE(%s, %s)", quote(col.Name), col.Default))
+		} else {
+			lValues = append(lValues, quote(col.Name))
+		}
+	}
+	plan.add(table.Name, fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s", quote(lTmpName),
+		strings.Join(lCols, ", "), strings.Join(lValues, ", "), quote(table.Name)), "rebuild table: copy data")
+	plan.add(table.Name, fmt.Sprintf("DROP TABLE %s", quote(table.Name)), "rebuild table: drop old table")
+	plan.add(table.Name, fmt.Sprintf("ALTER TABLE %s RENAME TO %s", quote(lTmpName), quote(table.Name)),
+		"rebuild table: rename new table")
+
+	// 重建 Model 的索引
+	for _, name := range indexNames(table.Indexes) {
+		plan.add(table.Name, self.Dialect().CreateIndexSql(table.Name, table.Indexes[name]), "rebuild table: index %s", name)
+	}
+
+	// 其他索引按索引策略重建或删除
+	for _, name := range indexNames(dbTable.Indexes) {
+		index := dbTable.Indexes[name]
+
+		lDeclared := false
+		for _, index2 := range table.Indexes {
+			if index.Equal(index2) && index.Type == index2.Type {
+				lDeclared = true
+				break
+			}
+		}
+		if lDeclared {
+			continue
+		}
+
+		if self.IndexPolicy.owns(index) {
+			plan.note("Table %s index %s dropped by rebuild: not declared by the model (index policy %s)",
+				table.Name, name, self.IndexPolicy)
+			continue
+		}
+
+		lExists := true
+		for _, col := range index.Cols {
+			lExists = lExists && table.GetColumn(col) != nil
+		}
+		if !lExists {
+			plan.note("Table %s index %s dropped by rebuild: its columns no longer exist", table.Name, name)
+			continue
+		}
+
+		lUnique, lName := "", name
+		if index.Type == core.UniqueType {
+			lUnique = "UNIQUE "
+		}
+		if index.IsRegular {
+			lName = index.XName(table.Name)
+		}
+		plan.add(table.Name, fmt.Sprintf("CREATE %sINDEX %s ON %s (%s)", lUnique, quote(lName),
+			quote(table.Name), quote(strings.Join(index.Cols, quote(",")))), "rebuild table: keep index %s", name)
+	}
+}
+
+// 重命名以 oldname 标记且新字段不存在的字段 ORM 创建的索引随之改名
+// 返回重命名后的数据库表结构用于后续比较
+func (self *TOrm) planRename(plan *TSyncPlan, table, dbTable *core.Table) *core.Table {
+	lTable := self.TableByType(table.Type)
+	if lTable == nil {
+		return dbTable
+	}
+
+	quote := self.Quote
+	lRenames := make(map[string]string) // 原字段名 -> 新字段名
+	for _, col := range table.Columns() {
+		lField := lTable.FieldByColumn(col.Name)
+		if lField == nil || lField.oldname == "" || dbTable.GetColumn(col.Name) != nil {
+			continue
+		}
+
+		lOrgCol := dbTable.GetColumn(lField.oldname)
+		if lOrgCol == nil {
+			continue
+		}
+
+		lSql := fmt.Sprintf("ALTER TABLE %s RENAME COLUMN %s TO %s", quote(table.Name), quote(lOrgCol.Name), quote(col.Name))
+		if self.Dialect().DBType() == core.MYSQL {
+			// 只改名 类型等变更由后续比较处理
+			lCol := *lOrgCol
+			lCol.Name = col.Name
+			lSql = fmt.Sprintf("ALTER TABLE %s CHANGE COLUMN %s %s", quote(table.Name), quote(lOrgCol.Name), lCol.StringNoPk(self.Dialect()))
+		}
+		plan.add(table.Name, lSql, "column %s renamed from %s", col.Name, lOrgCol.Name)
+		lRenames[strings.ToLower(lOrgCol.Name)] = col.Name
+	}
+
+	if len(lRenames) == 0 {
+		return dbTable
+	}
+
+	lNew := core.NewEmptyTable()
+	lNew.Name = dbTable.Name
+	lNew.Type = dbTable.Type
+	for _, col := range dbTable.Columns() {
+		lCol := *col
+		if name, has := lRenames[strings.ToLower(col.Name)]; has {
+			lCol.Name = name
+		}
+		lNew.AddColumn(&lCol)
+	}
+
+	for _, name := range indexNames(dbTable.Indexes) {
+		index := dbTable.Indexes[name]
+		lIndex := *index
+		lIndex.Cols = make([]string, len(index.Cols))
+
+		lRenamed := false
+		for idx, col := range index.Cols {
+			if lNewName, has := lRenames[strings.ToLower(col)]; has {
+				col = lNewName
+				lRenamed = true
+			}
+			lIndex.Cols[idx] = col
+		}
+
+		// ORM 创建的索引名称随字段改变
+		if lRenamed && index.IsRegular {
+			for _, name2 := range indexNames(table.Indexes) {
+				if index2 := table.Indexes[name2]; name2 != name && lIndex.Equal(index2) && lIndex.Type == index2.Type {
+					self.planRenameIndex(plan, table.Name, index, index2)
+					lIndex.Name = name2
+					break
+				}
+			}
+		}
+		lNew.AddIndex(&lIndex)
+	}
+	return lNew
+}
+
+// 重命名索引 sqlite 删除后重建
+func (self *TOrm) planRenameIndex(plan *TSyncPlan, table string, index, newIndex *core.Index) {
+	quote := self.Quote
+	lOld, lNew := index.XName(table), newIndex.XName(table)
+	switch self.Dialect().DBType() {
+	case core.POSTGRES:
+		plan.add(table, fmt.Sprintf("ALTER INDEX %s RENAME TO %s", quote(lOld), quote(lNew)),
+			"index %s renamed from %s", newIndex.Name, index.Name)
+	case core.MYSQL:
+		plan.add(table, fmt.Sprintf("ALTER TABLE %s RENAME INDEX %s TO %s", quote(table), quote(lOld), quote(lNew)),
+			"index %s renamed from %s", newIndex.Name, index.Name)
+	default:
+		plan.add(table, self.Dialect().DropIndexSql(table, index), "index %s renamed from %s", newIndex.Name, index.Name)
+		plan.add(table, self.Dialect().CreateIndexSql(table, newIndex), "index %s renamed from %s", newIndex.Name, index.Name)
+	}
+}
+
+// 字段类型 只包括 char/varchar/decimal 的长度
+func (self *TOrm) columnType(col *core.Column) string {
+	return columnTypeOf(self.Dialect().SqlType(col), col)
+}
+
+// 其他类型的长度不影响存储 如 mysql 5.x 整数类型的显示宽度 INT(11) 与 INT 相同
+func columnTypeOf(sqlType string, col *core.Column) string {
+	switch strings.ToUpper(col.SQLType.Name) {
+	case core.Char, core.Varchar, core.NVarchar, core.Decimal, core.Numeric:
+		if strings.Contains(sqlType, "(") || col.Length == 0 {
+			return sqlType
+		}
+		if col.Length2 > 0 {
+			return sqlType + "(" + strconv.Itoa(col.Length) + "," + strconv.Itoa(col.Length2) + ")"
+		}
+		return sqlType + "(" + strconv.Itoa(col.Length) + ")"
+	}
+
+	if lStart := strings.Index(sqlType, "("); lStart > 0 {
+		if lEnd := strings.Index(sqlType[lStart:], ")"); lEnd > 0 {
+			return strings.TrimSpace(sqlType[:lStart] + sqlType[lStart+lEnd+1:])
+		}
+	}
+	return sqlType
+}
+
+// 用于显示的字段定义
+func (self *TOrm) describeColumn(col *core.Column) string {
+	lDesc := self.columnType(col)
+	if !col.Nullable {
+		lDesc += " NOT NULL"
+	}
+	if col.Default != "" {
+		lDesc += " DEFAULT " + col.Default
+	}
+	return lDesc
+}
+
+// 从 from 改为 to 是否不会丢失数据
+func widens(from, to *core.Column) bool {
+	lFrom, ok1 := typeRanks[strings.ToUpper(from.SQLType.Name)]
+	lTo, ok2 := typeRanks[strings.ToUpper(to.SQLType.Name)]
+	if !ok1 || !ok2 {
+		return false
+	}
+
+	if lFrom[0] == lTo[0] {
+		switch {
+		case lTo[1] != lFrom[1]:
+			return lTo[1] > lFrom[1]
+		case lTo[0] == 3: // decimal 整数位及小数位都不能减少
+			return to.Length-to.Length2 >= from.Length-from.Length2 && to.Length2 >= from.Length2
+		case lTo[0] == 4: // 长度为 0 表示不限长度
+			return to.Length == 0 || (from.Length > 0 && to.Length >= from.Length)
+		}
+		return true
+	}
+
+	switch {
+	case lTo[0] == 4 && lTo[1] >= 3: // 任何值都可以转为文本
+		return true
+	case lFrom[0] == 1:
+		return lTo[0] == 2 || lTo[0] == 3
+	}
+	return false
+}
+
+// 统一默认值格式 去掉 postgres 的类型转换及引号
+func normDefault(def string) string {
+	def = strings.TrimSpace(def)
+	if idx := strings.Index(def, "::"); idx > 0 {
+		def = def[:idx]
+	}
+	def = strings.Trim(def, "()")
+	def = strings.Trim(def, `'"`)
+	return strings.ToLower(def)
+}
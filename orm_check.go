@@ -0,0 +1,188 @@
+package orm
+
+/** Model 定义检查
+映射 Model 时收集所有定义错误 而不是在第一个错误处中止
+SyncModel/SyncModels/PlanSync 返回 TModelErrors 列出每个错误所在的 Model 及字段
+检查: Tag 语法及参数 未知的 Tag 重复的数据库字段名 缺少自增主键(RecordField) 未知的关联 Model ondelete 策略及 enforce 约束
+	经 extends/relate/delegate 成员的循环嵌入
+例如:
+	if _, err := orm.SyncModels(new(ResPartner), new(ResUsers)); err != nil {
+		if errs, ok := err.(orm.TModelErrors); ok {
+			for _, e := range errs {
+				fmt.Println(e.Model, e.Field, e.Msg)
+			}
+		}
+	}
+*/
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+
+	core "github.com/go-xorm/core"
+)
+
+type (
+	// 一个 Model 定义错误 Field 为空时属于整个 Model
+	TModelError struct {
+		Model string
+		Field string
+		Msg   string
+	}
+
+	// Model 定义错误列表
+	TModelErrors []*TModelError
+)
+
+func (self *TModelError) Error() string {
+	if self.Field == "" {
+		return fmt.Sprintf("model %s: %s", self.Model, self.Msg)
+	}
+	return fmt.Sprintf("model %s field %s: %s", self.Model, self.Field, self.Msg)
+}
+
+func (self TModelErrors) Error() string {
+	if len(self) == 1 {
+		return self[0].Error()
+	}
+
+	var lBuf bytes.Buffer
+	lBuf.WriteString(fmt.Sprintf("%d model definition errors:", len(self)))
+	for _, err := range self {
+		lBuf.WriteString("\n\t" + err.Error())
+	}
+	return lBuf.String()
+}
+
+// 添加一个错误 相同的错误只记录一次
+func (self *TModelErrors) add(model, field string, format string, args ...interface{}) {
+	lErr := &TModelError{
+		Model: model,
+		Field: field,
+		Msg:   fmt.Sprintf(format, args...),
+	}
+
+	for _, err := range *self {
+		if *err == *lErr {
+			return
+		}
+	}
+	*self = append(*self, lErr)
+}
+
+// 合并其他错误 如父 Model 的映射错误
+func (self *TModelErrors) merge(model string, err error) {
+	switch e := err.(type) {
+	case nil:
+	case TModelErrors:
+		for _, lErr := range e {
+			self.add(lErr.Model, lErr.Field, "%s", lErr.Msg)
+		}
+	case *TModelError:
+		self.add(e.Model, e.Field, "%s", e.Msg)
+	case *TTagError:
+		self.add(e.Model, e.Member, "tag error at column %d: %s", e.Pos, e.Msg)
+	default:
+		self.add(model, "", "%v", err)
+	}
+}
+
+// 无错误时返回 nil 避免返回非 nil 的空列表
+func (self TModelErrors) err() error {
+	if len(self) == 0 {
+		return nil
+	}
+	return self
+}
+
+// 检查已映射的 Model
+// comodels 为 true 时检查关联的 Model 是否已映射 单独同步的 Model 其关联 Model 可能稍后同步
+func (self *TOrm) checkModel(errs *TModelErrors, table *TTable, comodels bool) {
+	if table.RecordField == nil {
+		errs.add(table.Name, "", "no auto increment primary key (e.g. Id int64 `field:\"pk autoincr\"`)")
+	}
+
+	for _, name := range sortedFields(table) {
+		fld := table.Fields[name]
+		if fld.Type == "many2one" {
+			if _, err := fld.OnDelete(); err != nil {
+				errs.add(table.Name, fld.Name, "%v", err)
+			}
+		}
+
+		if fld.enforce != "" {
+			if fld.Type != "selection" {
+				errs.add(table.Name, fld.Name, "enforce is only supported on selection fields")
+			} else if fld.enforce != "check" && fld.enforce != "enum" {
+				errs.add(table.Name, fld.Name, "unknown enforce %q, must be check or enum", fld.enforce)
+			}
+		}
+
+		if !comodels {
+			continue
+		}
+
+		switch fld.Type {
+		case "one2many", "many2one", "many2many":
+			if fld.comodel_name != "" && self.TableByModel(fld.comodel_name) == nil {
+				errs.add(table.Name, fld.Name, "unknown comodel %s of %s field", fld.comodel_name, fld.Type)
+			}
+		}
+	}
+}
+
+// 由 xorm 处理的 Tag
+var xormTags = map[string]bool{
+	"null": true, "notnull": true, "version": true, "comment": true,
+	"cache": true, "nocache": true, "<-": true, "->": true,
+}
+
+// xorm 的 Tag 数据库类型(如 varchar decimal)或 'column_name'
+func isXormTag(name string) bool {
+	if strings.HasPrefix(name, "'") {
+		return true
+	}
+	if xormTags[strings.ToLower(name)] {
+		return true
+	}
+	_, has := core.SqlTypes[strings.ToUpper(name)]
+	return has
+}
+
+// 经 extends/relate/delegate 成员(值或指针)的循环嵌入 返回循环经过的成员 如 [A.B B.A] 无循环返回 nil
+func embedCycle(t reflect.Type, path []reflect.Type, members []string) []string {
+	for idx, lType := range path {
+		if lType == t {
+			return members[idx:]
+		}
+	}
+
+	path = append(path, t)
+	for i := 0; i < t.NumField(); i++ {
+		lMember := t.Field(i)
+		lItems, err := parseFieldTag(lMember.Tag.Get("field"))
+		if err != nil { // Tag 错误由 mapType 报告
+			continue
+		}
+
+		for _, item := range lItems {
+			switch strings.ToLower(item.Name) {
+			case "extends", "relate", "delegate":
+				lType := lMember.Type
+				if lType.Kind() == reflect.Ptr {
+					lType = lType.Elem()
+				}
+				if lType.Kind() != reflect.Struct {
+					continue
+				}
+
+				if res := embedCycle(lType, path, append(members, t.Name()+"."+lMember.Name)); res != nil {
+					return res
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package orm
+
+/** 计算字段
+compute(方法名) inverse(方法名) depends(字段,many2one字段.字段) store(true)
+不存储的计算字段在 Read 时计算 存储的计算字段在其依赖的字段被写入时重新计算
+依赖可以经 many2one 字段指向其他 Model 的字段
+*/
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"webgo/utils"
+)
+
+var (
+	recordType = reflect.TypeOf((*TRecordSet)(nil))
+	valuesType = reflect.TypeOf(map[string]interface{}(nil))
+)
+
+// 检查计算方法(kind 为 compute)或反向方法(kind 为 inverse)的签名 避免调用时 panic
+//
+//	compute: func(rec *TRecordSet) interface{}
+//	inverse: func(rec *TRecordSet, value interface{}) map[string]interface{}
+func checkMethod(model reflect.Type, kind, name string) error {
+	lMethod, ok := reflect.PtrTo(model).MethodByName(name)
+	if !ok {
+		return fmt.Errorf("%s method %s not found", kind, name)
+	}
+
+	// 方法类型的第一个参数为接收者
+	lType := lMethod.Type
+	switch kind {
+	case "compute":
+		if lType.NumIn() != 2 || !recordType.AssignableTo(lType.In(1)) || lType.NumOut() != 1 {
+			return fmt.Errorf("compute method %s must be func(rec *TRecordSet) interface{}", name)
+		}
+	case "inverse":
+		if lType.NumIn() != 3 || !recordType.AssignableTo(lType.In(1)) || lType.In(2).Kind() != reflect.Interface ||
+			lType.NumOut() != 1 || !lType.Out(0).AssignableTo(valuesType) {
+			return fmt.Errorf("inverse method %s must be func(rec *TRecordSet, value interface{}) map[string]interface{}", name)
+		}
+	}
+	return nil
+}
+
+// 调用 Model 的方法 nil 参数以对应类型的零值传入
+func (self *TTable) callMethod(name string, args ...interface{}) ([]reflect.Value, error) {
+	lMethod := reflect.New(self._cls_type).MethodByName(name)
+	if !lMethod.IsValid() {
+		return nil, fmt.Errorf("method %s of model %s not found", name, self.Name)
+	}
+
+	lType := lMethod.Type()
+	if lType.NumIn() != len(args) {
+		return nil, fmt.Errorf("method %s of model %s takes %d arguments", name, self.Name, lType.NumIn())
+	}
+
+	lIn := make([]reflect.Value, len(args))
+	for idx, arg := range args {
+		if arg == nil {
+			lIn[idx] = reflect.Zero(lType.In(idx))
+		} else {
+			lIn[idx] = reflect.ValueOf(arg)
+		}
+	}
+	return lMethod.Call(lIn), nil
+}
+
+// 计算记录的字段值
+func (self *TTable) computeValue(field *TField, rec *TRecordSet) (interface{}, error) {
+	lRes, err := self.callMethod(field.compute, rec)
+	if err != nil {
+		return nil, err
+	}
+	if len(lRes) != 1 {
+		return nil, fmt.Errorf("compute method %s of model %s must return one value", field.compute, self.Name)
+	}
+	return indirectValue(lRes[0].Interface()), nil
+}
+
+// 反向方法 返回需要写入的存储字段
+func (self *TTable) inverseValue(field *TField, rec *TRecordSet, value interface{}) (map[string]interface{}, error) {
+	lName, _ := field._fnct_inv.(string)
+	lRes, err := self.callMethod(lName, rec, value)
+	if err != nil {
+		return nil, err
+	}
+	if len(lRes) != 1 {
+		return nil, fmt.Errorf("inverse method %s of model %s must return map[string]interface{}", lName, self.Name)
+	}
+
+	lValues, _ := lRes[0].Interface().(map[string]interface{})
+	return lValues, nil
+}
+
+// 计算字段是否存储
+func (self *TField) IsComputed() bool {
+	return self.compute != ""
+}
+
+// 写入 table 的 ids 记录的 names 字段后 重新计算依赖这些字段的存储计算字段
+func (self *TOrmSession) recompute(table *TTable, ids []interface{}, names []string) error {
+	return self._recompute(table, ids, names, make(map[string]bool))
+}
+
+func (self *TOrmSession) _recompute(table *TTable, ids []interface{}, names []string, stack map[string]bool) error {
+	if len(ids) == 0 || len(names) == 0 {
+		return nil
+	}
+
+	for _, tbl := range self.Orm.allTables() {
+		for _, fld := range tbl.Fields {
+			if !fld.IsComputed() || !fld.Store {
+				continue
+			}
+
+			// 避免循环依赖
+			lKey := tbl.Name + "." + fld.Name
+			if stack[lKey] {
+				continue
+			}
+
+			lIds, err := self.dependents(tbl, fld, table, ids, names)
+			if err != nil {
+				return err
+			}
+			if len(lIds) == 0 {
+				continue
+			}
+
+			stack[lKey] = true
+			err = self.computeStored(tbl, fld, lIds)
+			if err == nil {
+				// 计算字段的变化继续传递
+				err = self._recompute(tbl, lIds, []string{fld.Name}, stack)
+			}
+			delete(stack, lKey)
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// 计算字段 field 的依赖中指向 table 的 names 字段的记录
+func (self *TOrmSession) dependents(tbl *TTable, field *TField, table *TTable, ids []interface{}, names []string) (res []interface{}, err error) {
+	lIds := make(map[string]interface{})
+	for _, dep := range field.Depends {
+		// 路径上的每个字段被修改都影响计算结果 如 partner_id.name 依赖 partner_id 及关联记录的 name
+		lPath := strings.Split(strings.TrimSpace(dep), ".")
+		for k := 1; k <= len(lPath); k++ {
+			if !utils.InStrings(lPath[k-1], names...) {
+				continue
+			}
+
+			// 当前表的字段
+			if k == 1 {
+				if tbl == table {
+					for _, id := range ids {
+						lIds[itf2Str(id)] = id
+					}
+				}
+				continue
+			}
+
+			// 经 many2one 字段的依赖 通过关联字段查找记录
+			lCompiler := newDomainCompiler(self.Orm, tbl)
+			lCompiler.read = true
+			lCol, lM2O, _, err := lCompiler.resolve(strings.Join(lPath[:k-1], "."))
+			if err != nil {
+				return nil, fmt.Errorf("depends %s of %s.%s: %v", dep, tbl.Name, field.Name, err)
+			}
+			if self.Orm.TableByModel(lM2O.comodel_name) != table {
+				continue
+			}
+
+			quote := self.Engine.Quote
+			ds, err := self.QueryArgs(fmt.Sprintf("SELECT %s.%s FROM %s %s WHERE %s IN (%s)",
+				quote(tbl.Name), quote(tbl.RecordField.Name), quote(tbl.Name),
+				strings.Join(lCompiler.query.Joins, " "), lCol, holders(len(ids))), ids...)
+			if err != nil {
+				return nil, err
+			}
+			for _, rec := range ds.Data {
+				lIds[itf2Str(rec.Value(0))] = rec.Value(0)
+			}
+		}
+	}
+
+	for _, id := range lIds {
+		res = append(res, id)
+	}
+	return
+}
+
+// 重新计算并保存记录的计算字段
+func (self *TOrmSession) computeStored(table *TTable, field *TField, ids []interface{}) error {
+	ds, err := self.Read(table.Name, ids, field.Depends...)
+	if err != nil {
+		return err
+	}
+
+	quote := self.Engine.Quote
+	for _, rec := range ds.Data {
+		lValue, err := table.computeValue(field, rec)
+		if err != nil {
+			return err
+		}
+
+		if _, err = self.execArgs(fmt.Sprintf("UPDATE %s SET %s = ? WHERE %s = ?", quote(table.Name),
+			quote(field.Name), quote(table.RecordField.Name)), lValue, rec._getByName(table.RecordField.Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package orm
+
+/** 流式数据集
+只进模式 数据集内存中只保留 Window 条记录 读完当前窗口后由游标读取下一批
+postgres 使用服务端游标 DECLARE/FETCH 其他数据库保持 sql.Rows 打开逐批读取
+*/
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	core "github.com/go-xorm/core"
+)
+
+type (
+	iDataCursor interface {
+		fetch(ds *TDataSet, limit int) (int, error)
+		close() error
+	}
+
+	// 保持 sql.Rows 打开的游标
+	rowsCursor struct {
+		rows    *core.Rows
+		session *TOrmSession // 非nil时关闭游标同时关闭该会话
+	}
+
+	// postgres 服务端游标
+	pgCursor struct {
+		session    *TOrmSession
+		name       string
+		ownTx      bool // 游标自己开启的事务 关闭时提交
+		ownSession bool // 游标自己创建的会话 关闭时关闭
+		done       bool
+	}
+)
+
+var (
+	StreamWindow int = 1000 // 流式数据集默认窗口大小
+
+	cursorSeq int64
+)
+
+// 流式查询 返回只进数据集 SQL 以 ? 为占位符
+// 使用完毕必须调用 Close() 释放游标
+func (self *TOrm) SqlStream(sql string, args ...interface{}) (*TDataSet, error) {
+	return self.NewSession().openStream(true, sql, args...)
+}
+
+// 流式查询 返回只进数据集 SQL 以 ? 为占位符
+// 会话在事务中时游标使用该事务 否则 postgres 会为游标开启事务并在 Close() 时提交
+func (self *TOrmSession) QueryStream(sql string, args ...interface{}) (*TDataSet, error) {
+	return self.openStream(false, sql, args...)
+}
+
+func (self *TOrmSession) openStream(ownSession bool, sql string, args ...interface{}) (ds *TDataSet, err error) {
+	ds = NewDataSet()
+	ds.Orm = self.Orm
+	ds.Window = StreamWindow
+
+	if self.Orm.DriverName() == "postgres" {
+		lCursor := &pgCursor{
+			session:    self,
+			name:       fmt.Sprintf("orm_cursor_%d", atomic.AddInt64(&cursorSeq, 1)),
+			ownSession: ownSession,
+		}
+
+		if self.IsAutoCommit || self.Tx == nil {
+			if err = self.Begin(); err != nil {
+				return nil, err
+			}
+			lCursor.ownTx = true
+		}
+
+		lSql := fmt.Sprintf("DECLARE %s NO SCROLL CURSOR FOR %s", lCursor.name, sql)
+		if _, err = self.Tx.Exec(rebindSql(self.Orm.DriverName(), lSql), args...); err != nil {
+			lCursor.close()
+			return nil, err
+		}
+		ds.cursor = lCursor
+	} else {
+		var lRows *core.Rows
+		lRows, err = self.queryRows(sql, args...)
+		if err != nil {
+			if ownSession {
+				self.Close()
+			}
+			return nil, err
+		}
+
+		lCursor := &rowsCursor{rows: lRows}
+		if ownSession {
+			lCursor.session = self
+		}
+		ds.cursor = lCursor
+	}
+
+	if err = ds.fetch(); err != nil {
+		ds.Close()
+		return nil, err
+	}
+	return ds, nil
+}
+
+func (self *rowsCursor) fetch(ds *TDataSet, limit int) (int, error) {
+	return scanRows(self.rows, ds, limit)
+}
+
+func (self *rowsCursor) close() error {
+	err := self.rows.Close()
+	if self.session != nil {
+		self.session.Close()
+	}
+	return err
+}
+
+func (self *pgCursor) fetch(ds *TDataSet, limit int) (int, error) {
+	if self.done {
+		return 0, nil
+	}
+
+	lRows, err := self.session.Tx.Query(fmt.Sprintf("FETCH FORWARD %d FROM %s", limit, self.name))
+	if err != nil {
+		return 0, err
+	}
+	defer lRows.Close()
+
+	lCnt, err := scanRows(lRows, ds, -1)
+	if lCnt < limit {
+		self.done = true
+	}
+	return lCnt, err
+}
+
+func (self *pgCursor) close() (err error) {
+	if self.session.Tx != nil {
+		_, err = self.session.Tx.Exec("CLOSE " + self.name)
+	}
+
+	if self.ownTx {
+		if err != nil {
+			self.session.Rollback()
+		} else {
+			err = self.session.Commit()
+		}
+	}
+
+	if self.ownSession {
+		self.session.Close()
+	}
+	return
+}
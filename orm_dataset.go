@@ -7,44 +7,63 @@ import (
 	"fmt"
 	"reflect"
 	"strconv"
+	"strings"
 	"time"
 	"webgo/logger"
 	"webgo/utils"
 )
 
 type (
+	TRecordState int
+
 	TFieldSet struct {
 		DataSet *TDataSet
 		RecSet  *TRecordSet
 		Name    string
+		Type    reflect.Type // 字段值的原始类型 以第一个非NULL值为准
 	}
 
 	TRecordSet struct {
 		DataSet   *TDataSet
 		Fields    []string
-		Values    []string
+		Values    []interface{} // 保留原始类型的值 nil 为 NULL
 		NameIndex map[string]int
 		Length    int
+		State     TRecordState           // 变更状态
+		origin    map[string]interface{} // 修改前的值
 	}
 
 	TDataSet struct {
-		Data   []*TRecordSet         // []map[string]interface{}
-		Fields map[string]*TFieldSet //保存字段
-		//Delta // 修改过的
+		Orm          *TOrm                  // 产生该数据集的ORM 用于映射Model
+		Data         []*TRecordSet          // []map[string]interface{}
+		Fields       map[string]*TFieldSet  //保存字段
+		Delta        []*TRecordSet          // 变更日志 按发生顺序记录新增/修改/删除的记录
 		KeyField     string                 // 主键字段
 		RecordsIndex map[string]*TRecordSet // 主键引索
 		Position     int                    // 游标
 		//Count int
 
 		FieldCount int //字段数
+
+		Window int         // 流式数据集在内存中保留的记录数
+		cursor iDataCursor // 流式游标 非nil时为只进模式
+		winNo  int         // 已读取的窗口数
 	}
 )
 
+// 记录变更状态
+const (
+	RecUnchanged TRecordState = iota
+	RecInserted
+	RecModified
+	RecDeleted
+)
+
 func NewRecordSet(dataSet *TDataSet) *TRecordSet {
 	return &TRecordSet{
 		DataSet:   dataSet,
 		Fields:    make([]string, 0),
-		Values:    make([]string, 0),
+		Values:    make([]interface{}, 0),
 		NameIndex: make(map[string]int),
 		Length:    0,
 	}
@@ -56,11 +75,37 @@ func NewDataSet() *TDataSet {
 		KeyField:     "id",
 		Data:         make([]*TRecordSet, 0),
 		Fields:       make(map[string]*TFieldSet),
+		Delta:        make([]*TRecordSet, 0),
 		RecordsIndex: make(map[string]*TRecordSet),
 		//Count: 0,
 	}
 }
 
+// 是否为 NULL
+func (self *TFieldSet) IsNull() bool {
+	return self.RecSet.IsNull(self.RecSet.indexOf(self.Name))
+}
+
+// 设置为 NULL
+func (self *TFieldSet) SetNull() {
+	self.RecSet._setByName(self.Name, nil)
+}
+
+// 原始类型的值
+func (self *TFieldSet) AsInterface(src ...interface{}) interface{} {
+	if len(src) != 0 {
+		self.RecSet._setByName(self.Name, src[0])
+		return src[0]
+	}
+	return self.RecSet._getByName(self.Name)
+}
+
+// one2many 等字段的子数据集
+func (self *TFieldSet) AsDataSet() *TDataSet {
+	ds, _ := self.RecSet._getByName(self.Name).(*TDataSet)
+	return ds
+}
+
 func (self *TFieldSet) AsString(src ...string) string {
 	//RecSet := self.DataSet.Data[self.DataSet.Position]
 
@@ -69,79 +114,125 @@ func (self *TFieldSet) AsString(src ...string) string {
 		return src[0]
 	}
 	//fmt.Println("AsString", self, self.Name)
-	return self.RecSet._getByName(self.Name)
+	return itf2Str(self.RecSet._getByName(self.Name))
 }
 
 func (self *TFieldSet) AsInteger(src ...int64) int64 {
 	//RecSet := self.DataSet.Data[self.DataSet.Position]
 
 	if len(src) != 0 {
-		self.RecSet._setByName(self.Name, utils.IntToStr(src[0]))
+		self.RecSet._setByName(self.Name, src[0])
 		return src[0]
 	}
-	return utils.StrToInt64(self.RecSet._getByName(self.Name))
+	return itf2Int(self.RecSet._getByName(self.Name))
 }
 
 func (self *TFieldSet) AsBoolean(src ...bool) bool {
 	//RecSet := self.DataSet.Data[self.DataSet.Position]
 
 	if len(src) != 0 {
-		self.RecSet._setByName(self.Name, utils.BoolToStr(src[0]))
+		self.RecSet._setByName(self.Name, src[0])
 		return src[0]
 	}
-	return utils.StrToBool(self.RecSet._getByName(self.Name))
+	return itf2Bool(self.RecSet._getByName(self.Name))
 }
 
 func (self *TFieldSet) AsDateTime(src ...time.Time) (t time.Time) {
 	//RecSet := self.DataSet.Data[self.DataSet.Position]
 	if len(src) != 0 {
-		self.RecSet._setByName(self.Name, src[0].Format(time.RFC3339))
+		self.RecSet._setByName(self.Name, src[0])
 		return src[0]
 	}
-	t, _ = time.Parse(time.RFC3339, self.RecSet._getByName(self.Name))
-	return
+	return itf2Time(self.RecSet._getByName(self.Name))
 }
 
 func (self *TFieldSet) AsFloat(src ...float64) float64 {
 	//RecSet := self.DataSet.Data[self.DataSet.Position]
 
 	if len(src) != 0 {
-		self.RecSet._setByName(self.Name, utils.FloatToStr(src[0]))
+		self.RecSet._setByName(self.Name, src[0])
 		return src[0]
 	}
 
-	return utils.StrToFloat(self.RecSet._getByName(self.Name))
+	return itf2Float(self.RecSet._getByName(self.Name))
 }
 
 func (self *TRecordSet) Get(index int) string {
-	if index >= self.Length {
+	if index < 0 || index >= self.Length {
 		return ""
 	}
 	//fmt.Println("_getByName Get", index, self.Values)
-	return self.Values[index]
+	return itf2Str(self.Values[index])
 }
 
 func (self *TRecordSet) Set(index int, value string) bool {
-	if index >= self.Length {
+	return self.SetValue(index, value)
+}
+
+// 获取原始类型的值 NULL 返回 nil
+func (self *TRecordSet) Value(index int) interface{} {
+	if index < 0 || index >= self.Length {
+		return nil
+	}
+	return self.Values[index]
+}
+
+func (self *TRecordSet) SetValue(index int, value interface{}) bool {
+	if index < 0 || index >= self.Length {
 		return false
 	}
+	self.modify()
 	self.Values[index] = value
 	return true
 }
 
-func (self *TRecordSet) _getByName(name string) string {
+// 记录修改前的值并写入变更日志
+func (self *TRecordSet) modify() {
+	if self.State != RecUnchanged {
+		return
+	}
+
+	self.origin = self.ToItfMap()
+	self.State = RecModified
+	if self.DataSet != nil {
+		self.DataSet.Delta = append(self.DataSet.Delta, self)
+	}
+}
+
+// 修改前的值 未修改的记录返回当前值
+func (self *TRecordSet) OldValue(name string) interface{} {
+	if self.origin != nil {
+		return self.origin[name]
+	}
+	return self._getByName(name)
+}
+
+// 不存在的字段视为 NULL
+func (self *TRecordSet) IsNull(index int) bool {
+	return self.Value(index) == nil
+}
+
+func (self *TRecordSet) indexOf(name string) int {
+	if index, ok := self.NameIndex[name]; ok {
+		return index
+	}
+	return -1
+}
+
+func (self *TRecordSet) _getByName(name string) interface{} {
 	//fmt.Println("_getByName", self.NameIndex)
 	if index, ok := self.NameIndex[name]; ok {
 		//fmt.Println("_getByName", index, self.Get(index))
-		return self.Get(index)
+		return self.Value(index)
 	}
-	return ""
+	return nil
 }
 
-func (self *TRecordSet) _setByName(name string, value string) bool {
+func (self *TRecordSet) _setByName(name string, value interface{}) bool {
 	if index, ok := self.NameIndex[name]; ok {
-		return self.Set(index, value)
+		return self.SetValue(index, value)
 	} else {
+		self.modify()
 		self.NameIndex[name] = len(self.Values)
 		self.Fields = append(self.Fields, name)
 		self.Values = append(self.Values, value)
@@ -150,6 +241,19 @@ func (self *TRecordSet) _setByName(name string, value string) bool {
 	return true
 }
 
+// 直接设置值 不记入变更日志
+func (self *TRecordSet) setRaw(name string, value interface{}) {
+	if index, ok := self.NameIndex[name]; ok {
+		self.Values[index] = value
+		return
+	}
+
+	self.NameIndex[name] = len(self.Values)
+	self.Fields = append(self.Fields, name)
+	self.Values = append(self.Values, value)
+	self.Length = len(self.Values)
+}
+
 func (self *TRecordSet) GetByIndex(index int) (res *TFieldSet) {
 	// 检查零界
 	if index >= self.Length && len(self.DataSet.Fields) != self.Length {
@@ -182,7 +286,7 @@ func (self *TRecordSet) ToStrMap() (res map[string]string) {
 	res = make(map[string]string)
 
 	for idx, field := range self.Fields {
-		res[field] = self.Values[idx]
+		res[field] = itf2Str(self.Values[idx])
 	}
 
 	return
@@ -200,7 +304,7 @@ func (self *TRecordSet) ToItfMap() (res map[string]interface{}) {
 
 func (self *TRecordSet) MergeToStrMap(target map[string]string) (res map[string]string) {
 	for idx, field := range self.Fields {
-		target[field] = self.Values[idx]
+		target[field] = itf2Str(self.Values[idx])
 	}
 
 	return target
@@ -209,7 +313,7 @@ func (self *TRecordSet) MergeToStrMap(target map[string]string) (res map[string]
 func (self *TRecordSet) AsStrMap() (res map[string]string) {
 	res = make(map[string]string)
 	for idx, field := range self.Fields {
-		res[field] = self.Values[idx]
+		res[field] = itf2Str(self.Values[idx])
 	}
 
 	return
@@ -242,12 +346,53 @@ func (self *TDataSet) Count() int {
 	return len(self.Data)
 }
 
+// 流式数据集只能回到第一个窗口的开头
 func (self *TDataSet) First() {
+	if self.cursor != nil && self.winNo > 1 {
+		logger.Logger.Error("First() is not supported on a forward-only dataset after the first window")
+		return
+	}
 	self.Position = 0
 }
 
 func (self *TDataSet) Next() {
 	self.Position++
+
+	// 流式数据集读取下一个窗口
+	if self.cursor != nil && self.Position >= len(self.Data) {
+		logger.LogErr(self.fetch())
+	}
+}
+
+// 是否为流式只进数据集
+func (self *TDataSet) IsStream() bool {
+	return self.cursor != nil
+}
+
+// 读取下一个窗口 释放当前窗口的记录
+func (self *TDataSet) fetch() (err error) {
+	if self.Window <= 0 {
+		self.Window = StreamWindow
+	}
+
+	self.Data = make([]*TRecordSet, 0, self.Window)
+	self.RecordsIndex = make(map[string]*TRecordSet)
+	self.Position = 0
+	self.winNo++
+
+	_, err = self.cursor.fetch(self, self.Window)
+	return
+}
+
+// 关闭流式数据集的游标 普通数据集无需关闭
+func (self *TDataSet) Close() error {
+	if self.cursor == nil {
+		return nil
+	}
+
+	err := self.cursor.close()
+	self.cursor = nil
+	return err
 }
 
 func (self *TDataSet) Eof() bool {
@@ -260,38 +405,31 @@ func (self *TDataSet) Record() *TRecordSet {
 
 //push row to dataset
 func (self *TDataSet) NewRecord(Record map[string]interface{}) bool {
-	//var lRec *TRecordSet
-	lRec := NewRecordSet(self)
-	var err error
-	lValue := ""
+	lFields := make([]string, 0, len(Record))
+	lValues := make([]interface{}, 0, len(Record))
 	for field, val := range Record {
-		if val == nil {
-			lValue = ""
-		} else {
-			rawValue := reflect.Indirect(reflect.ValueOf(val))
-			//if row is null then ignore
-			if rawValue.Interface() == nil {
-				continue
-			}
-
-			lValue, err = val2Str(&rawValue)
-			if logger.LogErr(err) {
-				return false
-			}
+		lFields = append(lFields, field)
+		lValues = append(lValues, indirectValue(val))
+	}
 
-		}
+	self.appendRecord(lFields, lValues)
+	return true
+}
 
-		//Record[field] = data
+// 按字段顺序添加一条记录 values 中 nil 为 NULL
+func (self *TDataSet) appendRecord(fields []string, values []interface{}) *TRecordSet {
+	lRec := NewRecordSet(self)
+	for idx, field := range fields {
+		lValue := values[idx]
 		lRec.NameIndex[field] = len(lRec.Fields) // 先于 lRec.Fields 添加不需 -1
 		lRec.Fields = append(lRec.Fields, field)
 		lRec.Values = append(lRec.Values, lValue)
 
-		if self.KeyField != "" {
+		if self.KeyField != "" && lValue != nil {
 			if field == self.KeyField || field == "id" {
-				self.RecordsIndex[lValue] = lRec //保存ID 对应的 Record
+				self.RecordsIndex[itf2Str(lValue)] = lRec //保存ID 对应的 Record
 			}
 		}
-
 	}
 
 	// 添加字段长度
@@ -301,44 +439,123 @@ func (self *TDataSet) NewRecord(Record map[string]interface{}) bool {
 
 	//TODO 迁移到其他地方初始化
 	// 记录该数据集的字段
-	if self.Count() < 1 {
-		for _, field := range lRec.Fields {
-			fieldSet := &TFieldSet{
+	for idx, field := range lRec.Fields {
+		fieldSet, has := self.Fields[field]
+		if !has {
+			fieldSet = &TFieldSet{
 				DataSet: self,
 				//RecSet:  self.Data[self.Position],
 				Name: field,
 			}
 			self.Fields[field] = fieldSet
 		}
+
+		// 记录原始类型
+		if fieldSet.Type == nil && lRec.Values[idx] != nil {
+			fieldSet.Type = reflect.TypeOf(lRec.Values[idx])
+		}
 	}
 
 	//self.Data = append(self.Data, Record)
 	lRec.Length = len(lRec.Values) // 更新记录列数
 	self.Data = append(self.Data, lRec)
-	return true
+	return lRec
+}
+
+// 登记数据集字段
+func (self *TDataSet) addFieldSet(name string) {
+	if _, has := self.Fields[name]; !has {
+		self.Fields[name] = &TFieldSet{DataSet: self, Name: name}
+	}
+}
+
+// 新增一条记录并记入变更日志
+func (self *TDataSet) AppendRecord(Record map[string]interface{}) *TRecordSet {
+	lFields := make([]string, 0, len(Record))
+	lValues := make([]interface{}, 0, len(Record))
+	for field, val := range Record {
+		lFields = append(lFields, field)
+		lValues = append(lValues, indirectValue(val))
+	}
+
+	lRec := self.appendRecord(lFields, lValues)
+	lRec.State = RecInserted
+	self.Delta = append(self.Delta, lRec)
+	return lRec
 }
 
+// 删除主键对应的记录并记入变更日志
 func (self *TDataSet) DeleteRecord(Key string) bool {
+	lRec := self.RecordByKey(Key)
+	if lRec == nil {
+		return false
+	}
+
+	for idx, rec := range self.Data {
+		if rec == lRec {
+			self.Data = append(self.Data[:idx], self.Data[idx+1:]...)
+			if self.Position > idx {
+				self.Position--
+			}
+			break
+		}
+	}
+	delete(self.RecordsIndex, Key)
+
+	switch lRec.State {
+	case RecInserted: // 未提交的新记录直接移出日志
+		for idx, rec := range self.Delta {
+			if rec == lRec {
+				self.Delta = append(self.Delta[:idx], self.Delta[idx+1:]...)
+				break
+			}
+		}
+	case RecUnchanged:
+		lRec.origin = lRec.ToItfMap()
+		self.Delta = append(self.Delta, lRec)
+	}
+	lRec.State = RecDeleted
 	return true
 }
 
-//考虑
+// 修改主键对应的记录 修改前的值记入变更日志
 func (self *TDataSet) EditRecord(Key string, Record map[string]interface{}) bool {
+	lRec := self.RecordByKey(Key)
+	if lRec == nil {
+		return false
+	}
+
+	for field, val := range Record {
+		lRec._setByName(field, indirectValue(val))
+	}
 	return true
 }
 
+// 未提交的变更数
+func (self *TDataSet) ChangeCount() int {
+	return len(self.Delta)
+}
+
+// 清空变更日志 当前值作为原始值
+func (self *TDataSet) MergeChangeLog() {
+	for _, rec := range self.Delta {
+		rec.State = RecUnchanged
+		rec.origin = nil
+	}
+	self.Delta = make([]*TRecordSet, 0)
+}
+
 func (self *TDataSet) RecordByField(field string, val interface{}) (rec *TRecordSet) {
 	if field == "" || val == nil {
 		return nil
 	}
 
 	for _, rec = range self.Data {
-		i := rec.NameIndex[field]
-		if equal2Str(rec.Values[i], val) {
+		if i, has := rec.NameIndex[field]; has && equal2Str(rec.Values[i], val) {
 			return rec
 		}
 	}
-	return
+	return nil
 }
 
 // 获取对应KeyFieldd值
@@ -361,18 +578,28 @@ func (self *TDataSet) Keys() (res []string) {
 	return
 }
 
-func equal2Str(val1 string, val2 interface{}) bool {
-	rawValue := reflect.Indirect(reflect.ValueOf(val2))
-	//if row is null then ignore
-	if rawValue.Interface() == nil {
-
+func equal2Str(val1 interface{}, val2 interface{}) bool {
+	if val1 == nil || val2 == nil {
+		return val1 == nil && val2 == nil
 	}
-	lValue, err := val2Str(&rawValue)
-	if err != nil {
-		return false
+
+	return itf2Str(val1) == itf2Str(indirectValue(val2))
+}
+
+// 取出指针指向的值 nil 指针为 NULL
+func indirectValue(val interface{}) interface{} {
+	if val == nil {
+		return nil
 	}
 
-	return val1 == lValue
+	rawValue := reflect.ValueOf(val)
+	for rawValue.Kind() == reflect.Ptr {
+		if rawValue.IsNil() {
+			return nil
+		}
+		rawValue = rawValue.Elem()
+	}
+	return rawValue.Interface()
 }
 
 func val2Str(rawValue *reflect.Value) (data string, err error) {
@@ -383,6 +610,121 @@ func val2Str(rawValue *reflect.Value) (data string, err error) {
 	return
 }
 
+// 以下为原始类型值的转换 NULL 转为对应零值
+func itf2Str(val interface{}) string {
+	switch v := val.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	}
+
+	rawValue := reflect.ValueOf(val)
+	str, err := val2Str(&rawValue)
+	if err != nil {
+		return fmt.Sprintf("%v", val)
+	}
+	return str
+}
+
+func itf2Int(val interface{}) int64 {
+	switch v := val.(type) {
+	case nil:
+		return 0
+	case int64:
+		return v
+	case int:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case float64:
+		return int64(v)
+	case bool:
+		if v {
+			return 1
+		}
+		return 0
+	}
+	return utils.StrToInt64(itf2Str(val))
+}
+
+func itf2Float(val interface{}) float64 {
+	switch v := val.(type) {
+	case nil:
+		return 0
+	case float64:
+		return v
+	case float32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case int:
+		return float64(v)
+	}
+	return utils.StrToFloat(itf2Str(val))
+}
+
+func itf2Bool(val interface{}) bool {
+	switch v := val.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case int64:
+		return v != 0
+	}
+	return utils.StrToBool(itf2Str(val))
+}
+
+func itf2Time(val interface{}) (t time.Time) {
+	switch v := val.(type) {
+	case nil:
+		return
+	case time.Time:
+		return v
+	}
+
+	lStr := itf2Str(val)
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.Parse(layout, lStr); err == nil {
+			return t
+		}
+	}
+	return
+}
+
+// 驱动返回的 []byte 按数据库字段类型转换为原始类型
+// DECIMAL/NUMERIC 保留精确的字符串 需要时由 AsFloat 转换
+func normalizeValue(dbType string, val interface{}) interface{} {
+	lBytes, ok := val.([]byte)
+	if !ok {
+		return val
+	}
+
+	lStr := string(lBytes)
+	switch strings.ToUpper(dbType) {
+	case "INT", "INT2", "INT4", "INT8", "INTEGER", "TINYINT", "SMALLINT", "MEDIUMINT", "BIGINT", "SERIAL", "BIGSERIAL":
+		if i, err := strconv.ParseInt(lStr, 10, 64); err == nil {
+			return i
+		}
+	case "FLOAT", "FLOAT4", "FLOAT8", "DOUBLE", "REAL":
+		if f, err := strconv.ParseFloat(lStr, 64); err == nil {
+			return f
+		}
+	case "BOOL", "BOOLEAN":
+		if b, err := strconv.ParseBool(lStr); err == nil {
+			return b
+		}
+	case "BYTEA", "BLOB", "TINYBLOB", "MEDIUMBLOB", "LONGBLOB", "BINARY", "VARBINARY":
+		return lBytes
+	}
+	return lStr
+}
+
 func rft2val(rawValue *reflect.Value) (str string, err error) {
 	aa := reflect.TypeOf((*rawValue).Interface())
 	vv := reflect.ValueOf((*rawValue).Interface())
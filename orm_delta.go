@@ -0,0 +1,176 @@
+package orm
+
+/** 数据集变更提交
+将 TDataSet.Delta 中的新增/修改/删除转换为 INSERT/UPDATE/DELETE 在同一事务中执行 会话已开始的事务被沿用
+*/
+
+import (
+	"fmt"
+	"strings"
+)
+
+// 提交变更日志到 table 对应的数据库表
+// 所有语句在一个事务中执行 失败则回滚且变更日志保持不变
+// 会话已在事务中时加入该事务 由调用者提交或回滚
+func (self *TDataSet) ApplyUpdates(session *TOrmSession, table *TTable) (err error) {
+	defer session.writeScope()()
+
+	if table == nil || table.RecordField == nil {
+		return fmt.Errorf("ApplyUpdates: table has no record field")
+	}
+
+	if len(self.Delta) == 0 {
+		return nil
+	}
+
+	if err = session.validateRecords(table, self.Delta); err != nil {
+		return err
+	}
+
+	// 新记录主键在执行成功后才回写 失败时记录保持不变 可重新提交
+	lInserted := make(map[*TRecordSet]interface{})
+	err = session.transact(func() (err error) {
+		for _, rec := range self.Delta {
+			switch rec.State {
+			case RecInserted:
+				var lId interface{}
+				if lId, err = session.applyInsert(table, rec); err == nil && lId != nil {
+					lInserted[rec] = lId
+				}
+			case RecModified:
+				err = session.applyUpdate(table, rec)
+			case RecDeleted:
+				err = session.applyDelete(table, rec)
+			}
+
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for rec, id := range lInserted {
+		rec.setId(table.RecordField.Name, id)
+	}
+	self.MergeChangeLog()
+	return nil
+}
+
+// 记录中属于该表的数据库字段
+func (self *TTable) recordColumns(rec *TRecordSet) (cols []string, vals []interface{}) {
+	for idx, name := range rec.Fields {
+		lField := self.FieldByColumn(name)
+		if lField == nil || !lField.Store || lField.foreign_field {
+			continue
+		}
+		cols = append(cols, name)
+		vals = append(vals, rec.Values[idx])
+	}
+	return
+}
+
+// 在事务中执行绑定参数的SQL
+func (self *TOrmSession) execArgs(sql string, args ...interface{}) (int64, error) {
+	lRes, err := self.Session.Exec(rebindSql(self.Orm.DriverName(), sql), args...)
+	if err != nil {
+		return 0, err
+	}
+	return lRes.RowsAffected()
+}
+
+// 插入记录 返回数据库生成的主键 不修改记录 See TRecordSet.setId()
+func (self *TOrmSession) applyInsert(table *TTable, rec *TRecordSet) (interface{}, error) {
+	var (
+		lKey    = table.RecordField
+		lCols   []string
+		lArgs   []interface{}
+		lHolder []string
+	)
+
+	quote := self.Engine.Quote
+	lNames, lValues := table.recordColumns(rec)
+	for idx, name := range lNames {
+		// 自增主键由数据库生成
+		if name == lKey.Name && lKey.auto_increment && lValues[idx] == nil {
+			continue
+		}
+		lCols = append(lCols, quote(name))
+		lArgs = append(lArgs, lValues[idx])
+		lHolder = append(lHolder, "?")
+	}
+
+	lSql := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", quote(table.Name),
+		strings.Join(lCols, ","), strings.Join(lHolder, ","))
+	if len(lCols) == 0 && self.Orm.DriverName() != "mysql" {
+		// 所有字段使用默认值 如委托继承时无字段值的父记录
+		lSql = fmt.Sprintf("INSERT INTO %s DEFAULT VALUES", quote(table.Name))
+	}
+
+	// 回写新记录主键
+	var lId interface{}
+	if self.Orm.DriverName() == "postgres" {
+		ds, err := self.QueryArgs(lSql+" RETURNING "+quote(lKey.Name), lArgs...)
+		if err != nil {
+			return nil, err
+		}
+		if !ds.IsEmpty() {
+			lId = ds.Data[0].Value(0)
+		}
+	} else {
+		lRes, err := self.Session.Exec(lSql, lArgs...)
+		if err != nil {
+			return nil, err
+		}
+		if id, err := lRes.LastInsertId(); err == nil {
+			lId = id
+		}
+	}
+
+	return lId, nil
+}
+
+// 回写新记录的主键并加入主键索引
+func (self *TRecordSet) setId(key string, id interface{}) {
+	self.setRaw(key, id)
+	self.DataSet.RecordsIndex[itf2Str(id)] = self
+}
+
+func (self *TOrmSession) applyUpdate(table *TTable, rec *TRecordSet) error {
+	var (
+		lKey  = table.RecordField
+		lSets []string
+		lArgs []interface{}
+	)
+
+	quote := self.Engine.Quote
+	lNames, lValues := table.recordColumns(rec)
+	for idx, name := range lNames {
+		// 只提交改变的字段
+		if _, has := rec.origin[name]; has && equal2Str(rec.origin[name], lValues[idx]) {
+			continue
+		}
+		lSets = append(lSets, quote(name)+" = ?")
+		lArgs = append(lArgs, lValues[idx])
+	}
+
+	if len(lSets) == 0 {
+		return nil
+	}
+
+	lArgs = append(lArgs, rec.OldValue(lKey.Name))
+	_, err := self.execArgs(fmt.Sprintf("UPDATE %s SET %s WHERE %s = ?", quote(table.Name),
+		strings.Join(lSets, ", "), quote(lKey.Name)), lArgs...)
+	return err
+}
+
+func (self *TOrmSession) applyDelete(table *TTable, rec *TRecordSet) error {
+	lKey := table.RecordField
+	quote := self.Engine.Quote
+	_, err := self.execArgs(fmt.Sprintf("DELETE FROM %s WHERE %s = ?", quote(table.Name), quote(lKey.Name)),
+		rec.OldValue(lKey.Name))
+	return err
+}
@@ -0,0 +1,328 @@
+package orm
+
+/** Domain 查询条件
+格式与 OpenERP 一致 以前缀表示法组合条件 相邻的条件默认为 AND
+	[]interface{}{"|", []interface{}{"name", "ilike", "foo"}, []interface{}{"partner_id.country_id.code", "=", "CN"}}
+字段路径中的 many2one 字段自动 LEFT JOIN 其关联表
+支持的操作符: =, !=, <>, <, >, <=, >=, in, not in, like, not like, ilike, not ilike, child_of, =?
+*/
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+type (
+	TDomain []interface{}
+
+	// 编译后的查询条件 Where 中以 ? 为占位符
+	TDomainQuery struct {
+		Table *TTable
+		Where string
+		Joins []string
+		Args  []interface{}
+	}
+
+	domainCompiler struct {
+		orm    *TOrm
+		query  *TDomainQuery
+		items  TDomain
+		pos    int
+		joined map[string]bool // 已经 Join 的别名
+		read   bool            // 读取字段时解析路径 不检查 Searchable
+	}
+)
+
+func newDomainCompiler(orm *TOrm, table *TTable) *domainCompiler {
+	return &domainCompiler{
+		orm:    orm,
+		query:  &TDomainQuery{Table: table},
+		joined: make(map[string]bool),
+	}
+}
+
+// 将 domain 编译为对 table 的参数化查询条件
+func (self *TOrm) CompileDomain(table *TTable, domain TDomain) (*TDomainQuery, error) {
+	if table == nil {
+		return nil, fmt.Errorf("CompileDomain: table is nil")
+	}
+
+	lCompiler := newDomainCompiler(self, table)
+	lCompiler.items = domain
+
+	// 相邻的条件默认为 AND
+	lConds := make([]string, 0)
+	for lCompiler.pos < len(lCompiler.items) {
+		lCond, err := lCompiler.parse()
+		if err != nil {
+			return nil, err
+		}
+		lConds = append(lConds, lCond)
+	}
+
+	if len(lConds) == 0 {
+		lCompiler.query.Where = "1=1"
+	} else {
+		lCompiler.query.Where = strings.Join(lConds, " AND ")
+	}
+	return lCompiler.query, nil
+}
+
+// 按 domain 查询 model 对应的表 fields 为空时返回所有字段
+func (self *TOrmSession) Search(model string, domain TDomain, fields ...string) (*TDataSet, error) {
+	lTable := self.Orm.TableByModel(model)
+	if lTable == nil {
+		return nil, fmt.Errorf("Search: unknown model %s", model)
+	}
+
+	lQuery, err := self.Orm.CompileDomain(lTable, domain)
+	if err != nil {
+		return nil, err
+	}
+
+	quote := self.Engine.Quote
+	lCols := quote(lTable.Name) + ".*"
+	if len(fields) > 0 {
+		lNames := make([]string, 0, len(fields))
+		for _, name := range fields {
+			if lTable.FieldByColumn(name) == nil {
+				return nil, fmt.Errorf("Search: unknown field %s of model %s", name, model)
+			}
+			lNames = append(lNames, quote(lTable.Name)+"."+quote(name))
+		}
+		lCols = strings.Join(lNames, ",")
+	}
+
+	lSql := fmt.Sprintf("SELECT %s FROM %s %s WHERE %s", lCols, quote(lTable.Name),
+		strings.Join(lQuery.Joins, " "), lQuery.Where)
+	return self.QueryArgs(lSql, lQuery.Args...)
+}
+
+func (self *domainCompiler) parse() (string, error) {
+	if self.pos >= len(self.items) {
+		return "", fmt.Errorf("domain: missing operand for operator")
+	}
+
+	lItem := self.items[self.pos]
+	self.pos++
+
+	switch v := lItem.(type) {
+	case string:
+		switch v {
+		case "&", "|":
+			lLeft, err := self.parse()
+			if err != nil {
+				return "", err
+			}
+			lRight, err := self.parse()
+			if err != nil {
+				return "", err
+			}
+			if v == "&" {
+				return "(" + lLeft + " AND " + lRight + ")", nil
+			}
+			return "(" + lLeft + " OR " + lRight + ")", nil
+		case "!":
+			lCond, err := self.parse()
+			if err != nil {
+				return "", err
+			}
+			return "(NOT " + lCond + ")", nil
+		}
+		return "", fmt.Errorf("domain: unknown operator %q", v)
+	case []interface{}:
+		return self.leaf(v)
+	case TDomain:
+		return self.leaf(v)
+	}
+	return "", fmt.Errorf("domain: invalid item %v", lItem)
+}
+
+// 单个条件 [字段, 操作符, 值]
+func (self *domainCompiler) leaf(leaf []interface{}) (string, error) {
+	if len(leaf) != 3 {
+		return "", fmt.Errorf("domain: invalid leaf %v", leaf)
+	}
+
+	lPath, ok := leaf[0].(string)
+	if !ok {
+		return "", fmt.Errorf("domain: invalid field %v", leaf[0])
+	}
+	lOp, ok := leaf[1].(string)
+	if !ok {
+		return "", fmt.Errorf("domain: invalid operator %v", leaf[1])
+	}
+	lOp = strings.ToLower(strings.TrimSpace(lOp))
+	lValue := indirectValue(leaf[2])
+
+	lCol, lField, lTable, err := self.resolve(lPath)
+	if err != nil {
+		return "", err
+	}
+
+	switch lOp {
+	case "=?":
+		if lValue == nil || lValue == false {
+			return "1=1", nil
+		}
+		lOp = "="
+		fallthrough
+	case "=", "!=", "<>", "<", ">", "<=", ">=":
+		if lValue == nil {
+			switch lOp {
+			case "=":
+				return lCol + " IS NULL", nil
+			case "!=", "<>":
+				return lCol + " IS NOT NULL", nil
+			}
+			return "", fmt.Errorf("domain: operator %s can not compare %s with NULL", lOp, lPath)
+		}
+		self.query.Args = append(self.query.Args, lValue)
+		return lCol + " " + lOp + " ?", nil
+	case "in", "not in":
+		lList := domainList(lValue)
+		if len(lList) == 0 {
+			if lOp == "in" {
+				return "1=0", nil
+			}
+			return "1=1", nil
+		}
+		self.query.Args = append(self.query.Args, lList...)
+		return fmt.Sprintf("%s %s (%s)", lCol, strings.ToUpper(lOp), holders(len(lList))), nil
+	case "like", "not like", "ilike", "not ilike":
+		lNot := ""
+		if strings.HasPrefix(lOp, "not ") {
+			lNot = "NOT "
+		}
+		self.query.Args = append(self.query.Args, "%"+itf2Str(lValue)+"%")
+		if strings.HasSuffix(lOp, "ilike") {
+			if self.orm.DriverName() == "postgres" {
+				return lCol + " " + lNot + "ILIKE ?", nil
+			}
+			return "LOWER(" + lCol + ") " + lNot + "LIKE LOWER(?)", nil
+		}
+		return lCol + " " + lNot + "LIKE ?", nil
+	case "child_of":
+		return self.childOf(lCol, lField, lTable, lValue)
+	}
+	return "", fmt.Errorf("domain: unsupported operator %q", lOp)
+}
+
+// 解析字段路径 返回带表别名的字段及字段所在的表
+// 路径中除最后一个字段外都必须是 many2one 字段
+func (self *domainCompiler) resolve(path string) (col string, field *TField, table *TTable, err error) {
+	quote := self.orm.Quote
+	table = self.query.Table
+	lAlias := table.Name
+
+	lNames := strings.Split(path, ".")
+	lExpand := 0 // 关联字段展开次数 防止循环关联
+	for idx := 0; idx < len(lNames); idx++ {
+		name := lNames[idx]
+		field = table.FieldByColumn(name)
+		if field == nil {
+			return "", nil, nil, fmt.Errorf("domain: unknown field %s of %s", name, table.Name)
+		}
+
+		// 关联字段展开为其路径 如 partner_name -> partner_id.name
+		if field.IsRelatedPath() {
+			if lExpand++; lExpand > 16 {
+				return "", nil, nil, fmt.Errorf("domain: related field %s of %s is recursive", name, table.Name)
+			}
+			lRest := append(strings.Split(field.Related, "."), lNames[idx+1:]...)
+			lNames = append(lNames[:idx:idx], lRest...)
+			idx--
+			continue
+		}
+
+		// 关联表的字段不在本表 须经 many2one 字段路径查询
+		if field.foreign_field {
+			return "", nil, nil, fmt.Errorf("domain: field %s of %s is stored in a related table", name, table.Name)
+		}
+
+		if !field.Store || (!field.Searchable && !self.read) {
+			return "", nil, nil, fmt.Errorf("domain: field %s of %s is not searchable", name, table.Name)
+		}
+
+		if idx == len(lNames)-1 {
+			break
+		}
+
+		if field.Type != "many2one" {
+			return "", nil, nil, fmt.Errorf("domain: field %s of %s is not a many2one field", name, table.Name)
+		}
+
+		lCoTable := self.orm.TableByModel(field.comodel_name)
+		if lCoTable == nil || lCoTable.RecordField == nil {
+			return "", nil, nil, fmt.Errorf("domain: unknown model %s of field %s", field.comodel_name, name)
+		}
+
+		lCoAlias := lAlias + "__" + name
+		if !self.joined[lCoAlias] {
+			self.joined[lCoAlias] = true
+			self.query.Joins = append(self.query.Joins, fmt.Sprintf("LEFT JOIN %s AS %s ON %s.%s = %s.%s",
+				quote(lCoTable.Name), quote(lCoAlias),
+				quote(lCoAlias), quote(lCoTable.RecordField.Name),
+				quote(lAlias), quote(field.Name)))
+		}
+
+		table = lCoTable
+		lAlias = lCoAlias
+	}
+
+	return quote(lAlias) + "." + quote(field.Name), field, table, nil
+}
+
+// 记录及其所有下级记录 下级通过 parent_id 字段关联
+func (self *domainCompiler) childOf(col string, field *TField, table *TTable, value interface{}) (string, error) {
+	quote := self.orm.Quote
+
+	// 字段为 many2one 时层级表为关联表 否则必须是所在表的主键
+	var lTable *TTable
+	if field.Type == "many2one" {
+		lTable = self.orm.TableByModel(field.comodel_name)
+	} else if field == table.RecordField {
+		lTable = table
+	}
+
+	if lTable == nil || lTable.RecordField == nil {
+		return "", fmt.Errorf("domain: child_of on %s has no hierarchy table", field.Name)
+	}
+	if lTable.FieldByColumn("parent_id") == nil {
+		return "", fmt.Errorf("domain: child_of on %s requires a parent_id field on %s", field.Name, lTable.Name)
+	}
+
+	lIds := domainList(value)
+	if len(lIds) == 0 {
+		return "1=0", nil
+	}
+	self.query.Args = append(self.query.Args, lIds...)
+
+	lId := quote(lTable.RecordField.Name)
+	return fmt.Sprintf("%s IN (WITH RECURSIVE child_tree(id) AS (SELECT %s FROM %s WHERE %s IN (%s) "+
+		"UNION SELECT t.%s FROM %s t JOIN child_tree c ON t.%s = c.id) SELECT id FROM child_tree)",
+		col, lId, quote(lTable.Name), lId, holders(len(lIds)),
+		lId, quote(lTable.Name), quote("parent_id")), nil
+}
+
+// 值转为列表 单个值视为只有一个元素
+func domainList(value interface{}) (res []interface{}) {
+	if value == nil {
+		return
+	}
+
+	lValue := reflect.ValueOf(value)
+	if (lValue.Kind() == reflect.Slice || lValue.Kind() == reflect.Array) && lValue.Type().Elem().Kind() != reflect.Uint8 {
+		for i := 0; i < lValue.Len(); i++ {
+			res = append(res, lValue.Index(i).Interface())
+		}
+		return
+	}
+	return []interface{}{value}
+}
+
+// n 个 ? 占位符
+func holders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
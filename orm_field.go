@@ -223,9 +223,13 @@ type (
 		auto_increment    bool
 		index             bool // # whether the field is indexed in database
 		search            bool
-		read              bool //???
-		write             bool //???
-		translate         bool //???
+		read              bool   //???
+		write             bool   //???
+		translate         bool   //???
+		member_index      []int  // Model 中对应成员的索引路径 用于 reflect.Value.FieldByIndex
+		oldname           string // 字段原名称 同步时重命名数据库字段
+		compute           string // 计算字段的计算方法名
+		enforce           string // 选择字段的数据库约束 check/enum
 		// published exportable
 		Name              string // # name of the field
 		Store             bool
@@ -240,19 +244,19 @@ type (
 		Searchable        bool
 		Type              string                 // view 字段类型
 		Default           interface{}            //# default(recs) returns the default value
-		Related           string                 //???
+		Related           string                 // 关联字段路径 如 partner_id.name
 		Relation          string                 // #关系表
 		States            map[string]interface{} // #传递 UI 属性
-		Selection         map[string]interface{}
-		Company_dependent bool // ???
-		Change_default    bool // ???
+		Selection         TSelection             // 按顺序的选项
+		Company_dependent bool                   // ???
+		Change_default    bool                   // ???
 
 		// private membership
 		Groups     string //???
 		deprecated string //???
 		ondelete   string //???
 
-		_fnct_inv interface{} // ??? 函数,handler
+		_fnct_inv interface{} // 计算字段的反向方法名
 	}
 
 	TRelateField struct {
@@ -285,7 +289,9 @@ func NewField() *TField {
 		read:  true,
 		write: true,
 
-		Type: "unknown",
+		Store:      true,
+		Searchable: true,
+		Type:       "unknown",
 	}
 }
 func NewRelateField(aNames string, relate_table_name string, relate_field_name string, aField *TField, relate_topest_table string) *TRelateField {
@@ -342,6 +348,12 @@ func (self *TField) IsIndex() bool {
 func (self *TField) IsRelated() bool {
 	return self.related
 }
+
+// 是否为经 many2one 字段关联的字段 如 related(partner_id.name)
+func (self *TField) IsRelatedPath() bool {
+	return self.Related != "" && !self.Store
+}
+
 func (self *TField) Fnct_inv() interface{} {
 	return self._fnct_inv
 }
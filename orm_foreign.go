@@ -0,0 +1,181 @@
+package orm
+
+/** many2one 外键
+每个 many2one 字段以外键关联其关联表的主键 约束名为 FK_表名_字段名
+sqlite 不支持添加外键 外键在建表或重建表时创建 需以 _foreign_keys=1 连接使外键生效
+ondelete(restrict|cascade|set null) 指定删除关联记录时的处理 默认 set null 必填字段默认 restrict
+同步时删除策略改变的外键会被删除并重建
+*/
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"webgo/logger"
+
+	core "github.com/go-xorm/core"
+)
+
+// 计划同步与 table 相关且关联表已映射的 many2one 外键
+func (self *TOrm) planForeignKeys(plan *TSyncPlan, table *TTable) error {
+	switch self.Dialect().DBType() {
+	case core.POSTGRES, core.MYSQL:
+	case core.SQLITE:
+		// 外键在建表或重建表时创建
+		return nil
+	default:
+		logger.Dbg("foreign keys are not supported on", self.DriverName())
+		return nil
+	}
+
+	for _, tbl := range self.allTables() {
+		if tbl != table && !tbl.referTo(table) {
+			continue
+		}
+
+		// 计划中新建的表无外键
+		lExists := make(map[string]string)
+		if !plan.tables[tbl.Name] {
+			var err error
+			if lExists, err = self.foreignKeys(tbl.Name); err != nil {
+				return err
+			}
+		}
+
+		for _, name := range sortedFields(tbl) {
+			fld := tbl.Fields[name]
+			if fld.Type != "many2one" || !fld.Store || fld.foreign_field {
+				continue
+			}
+
+			// 关联的Model 尚未同步 待其同步时创建
+			lCoTable := self.TableByModel(fld.comodel_name)
+			if lCoTable == nil || lCoTable.RecordField == nil {
+				logger.Dbg("foreign key postponed:", tbl.Name, fld.Name, fld.comodel_name)
+				continue
+			}
+
+			if err := self.planForeignKey(plan, tbl, lCoTable, fld, lExists); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// 建表时创建的外键 sqlite 允许关联尚未创建的表
+func (self *TOrm) inlineForeignKeys(table *TTable) (res []string) {
+	quote := self.Quote
+	for _, name := range sortedFields(table) {
+		fld := table.Fields[name]
+		if fld.Type != "many2one" || !fld.Store || fld.foreign_field {
+			continue
+		}
+
+		lRule, err := fld.OnDelete()
+		if err != nil {
+			logger.Logger.Error("model %s field %s: %v", table.Name, fld.Name, err)
+			continue
+		}
+
+		lCoName, lCoKey := modelTableName(fld.comodel_name), "id"
+		if lCoTable := self.TableByModel(fld.comodel_name); lCoTable != nil && lCoTable.RecordField != nil {
+			lCoName, lCoKey = lCoTable.Name, lCoTable.RecordField.Name
+		}
+
+		res = append(res, fmt.Sprintf("CONSTRAINT %s FOREIGN KEY (%s) REFERENCES %s (%s) ON DELETE %s",
+			quote(fmt.Sprintf("FK_%s_%s", table.Name, fld.Name)), quote(fld.Name), quote(lCoName), quote(lCoKey), lRule))
+	}
+	return
+}
+
+// 按名称排序的字段名
+func sortedFields(table *TTable) []string {
+	lNames := make([]string, 0, len(table.Fields))
+	for name := range table.Fields {
+		lNames = append(lNames, name)
+	}
+	sort.Strings(lNames)
+	return lNames
+}
+
+// 表中是否有 many2one 字段关联到 table
+func (self *TTable) referTo(table *TTable) bool {
+	for _, fld := range self.Fields {
+		if fld.Type == "many2one" && modelTableName(fld.comodel_name) == table.Name {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *TOrm) planForeignKey(plan *TSyncPlan, table, coTable *TTable, field *TField, exists map[string]string) error {
+	lRule, err := field.OnDelete()
+	if err != nil {
+		return fmt.Errorf("model %s field %s: %v", table.Name, field.Name, err)
+	}
+
+	quote := self.Quote
+	lName := fmt.Sprintf("FK_%s_%s", table.Name, field.Name)
+	if lOldRule, has := exists[lName]; has {
+		if lOldRule == lRule {
+			return nil
+		}
+
+		// 删除策略改变 删除后重建
+		lSql := fmt.Sprintf("ALTER TABLE %s DROP CONSTRAINT %s", quote(table.Name), quote(lName))
+		if self.Dialect().DBType() == core.MYSQL {
+			lSql = fmt.Sprintf("ALTER TABLE %s DROP FOREIGN KEY %s", quote(table.Name), quote(lName))
+		}
+		plan.add(table.Name, lSql, "foreign key %s ondelete change from %s to %s", lName, lOldRule, lRule)
+	}
+
+	plan.add(table.Name, fmt.Sprintf("ALTER TABLE %s ADD CONSTRAINT %s FOREIGN KEY (%s) REFERENCES %s (%s) ON DELETE %s",
+		quote(table.Name), quote(lName), quote(field.Name), quote(coTable.Name), quote(coTable.RecordField.Name), lRule),
+		"new foreign key %s", lName)
+	return nil
+}
+
+// 表上已有的外键及其删除策略
+func (self *TOrm) foreignKeys(tableName string) (res map[string]string, err error) {
+	var lSql string
+	switch self.Dialect().DBType() {
+	case core.POSTGRES:
+		lSql = "SELECT tc.constraint_name, rc.delete_rule FROM information_schema.table_constraints tc " +
+			"JOIN information_schema.referential_constraints rc ON rc.constraint_name = tc.constraint_name " +
+			"AND rc.constraint_schema = tc.constraint_schema " +
+			"WHERE tc.table_name = ? AND tc.constraint_type = 'FOREIGN KEY'"
+	case core.MYSQL:
+		lSql = "SELECT CONSTRAINT_NAME, DELETE_RULE FROM information_schema.REFERENTIAL_CONSTRAINTS " +
+			"WHERE CONSTRAINT_SCHEMA = DATABASE() AND TABLE_NAME = ?"
+	}
+
+	ds, err := self.SqlQueryArgs(lSql, tableName)
+	if err != nil {
+		return nil, err
+	}
+
+	res = make(map[string]string)
+	for _, rec := range ds.Data {
+		res[rec.Get(0)] = strings.ToUpper(rec.Get(1))
+	}
+	return res, nil
+}
+
+// many2one 字段的外键删除策略 RESTRICT/CASCADE/SET NULL
+func (self *TField) OnDelete() (string, error) {
+	switch strings.ToLower(strings.Replace(strings.TrimSpace(self.ondelete), "_", " ", -1)) {
+	case "":
+		if self.Required {
+			return "RESTRICT", nil
+		}
+		return "SET NULL", nil
+	case "restrict":
+		return "RESTRICT", nil
+	case "cascade":
+		return "CASCADE", nil
+	case "set null", "setnull":
+		return "SET NULL", nil
+	}
+	return "", fmt.Errorf("unknown ondelete policy %q", self.ondelete)
+}
@@ -0,0 +1,291 @@
+package orm
+
+/** 版本迁移
+SyncModel 只同步新增的结构 数据迁移及删除字段等由注册的迁移完成
+已执行的迁移记录在 orm_migrations 表中 迁移按版本号的字符串顺序执行
+Migrate/Rollback 在一个事务中执行所有步骤 并以数据库锁避免多个实例同时迁移
+postgres: pg_advisory_xact_lock mysql: GET_LOCK sqlite: 事务的写锁
+例如:
+	func init() {
+		orm.RegisterMigration("20160501_001", "partner ref", func(s *orm.TOrmSession) error {
+			_, err := s.ExecArgs("UPDATE res_partner SET ref = code WHERE ref IS NULL")
+			return err
+		}, nil)
+	}
+
+	err = orm.Migrate("")
+*/
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+	"webgo/logger"
+
+	core "github.com/go-xorm/core"
+)
+
+const (
+	MigrationTable = "orm_migrations"
+
+	migrateLockKey     = 7237134830478419303 // postgres advisory lock 的 Key
+	migrateLockTimeout = 600                 // mysql GET_LOCK 等待秒数
+)
+
+type (
+	// 迁移步骤 在迁移会话的事务中执行
+	TMigrateFunc func(session *TOrmSession) error
+
+	TMigration struct {
+		Version string // 版本号 按字符串排序 如 20160501_001
+		Name    string
+		Up      TMigrateFunc
+		Down    TMigrateFunc // 为 nil 时不可回滚
+	}
+)
+
+var migrations = make(map[string]*TMigration)
+
+// 注册迁移 版本号不能重复
+func RegisterMigration(version, name string, up, down TMigrateFunc) {
+	if version == "" || up == nil {
+		logger.Panic("migration ", name, " needs a version and an up step!")
+	}
+	if _, has := migrations[version]; has {
+		logger.Panic("migration ", version, " is already registered!")
+	}
+
+	migrations[version] = &TMigration{
+		Version: version,
+		Name:    name,
+		Up:      up,
+		Down:    down,
+	}
+}
+
+// 按版本排序的已注册迁移
+func sortedMigrations(registered map[string]*TMigration) []*TMigration {
+	lVersions := make([]string, 0, len(registered))
+	for version := range registered {
+		lVersions = append(lVersions, version)
+	}
+	sort.Strings(lVersions)
+
+	res := make([]*TMigration, 0, len(lVersions))
+	for _, version := range lVersions {
+		res = append(res, registered[version])
+	}
+	return res
+}
+
+// 迁移到 target 版本 target 为空时迁移到最新版本
+// 高于 target 的已执行版本被回滚
+func (self *TOrm) Migrate(target string) error {
+	return self.migrate(func(applied []string) (ups, downs []*TMigration, err error) {
+		return planMigrate(migrations, applied, target)
+	})
+}
+
+// 回滚最后执行的 n 个迁移
+func (self *TOrm) Rollback(n int) error {
+	return self.migrate(func(applied []string) (ups, downs []*TMigration, err error) {
+		return nil, planRollback(migrations, applied, n)
+	})
+}
+
+// 由已执行的版本 applied 计算迁移到 target 需执行及回滚的迁移 applied 按版本排序
+// 回滚按版本从高到低 未注册或不可回滚的版本返回错误
+func planMigrate(registered map[string]*TMigration, applied []string, target string) (ups, downs []*TMigration, err error) {
+	if target != "" && registered[target] == nil {
+		return nil, nil, fmt.Errorf("migrate: unknown version %s", target)
+	}
+
+	lApplied := make(map[string]bool)
+	for _, version := range applied {
+		lApplied[version] = true
+	}
+
+	for _, m := range sortedMigrations(registered) {
+		if !lApplied[m.Version] && (target == "" || m.Version <= target) {
+			ups = append(ups, m)
+		}
+	}
+
+	if target != "" {
+		for idx := len(applied) - 1; idx >= 0 && applied[idx] > target; idx-- {
+			m, err := rollbackOf(registered, applied[idx])
+			if err != nil {
+				return nil, nil, err
+			}
+			downs = append(downs, m)
+		}
+	}
+	return
+}
+
+// 回滚最后执行的 n 个迁移 applied 按版本排序
+func planRollback(registered map[string]*TMigration, applied []string, n int) (downs []*TMigration, err error) {
+	for idx := len(applied) - 1; idx >= 0 && len(downs) < n; idx-- {
+		m, err := rollbackOf(registered, applied[idx])
+		if err != nil {
+			return nil, err
+		}
+		downs = append(downs, m)
+	}
+	return
+}
+
+// 可回滚的已注册迁移
+func rollbackOf(registered map[string]*TMigration, version string) (*TMigration, error) {
+	m := registered[version]
+	if m == nil {
+		return nil, fmt.Errorf("rollback: version %s is not registered", version)
+	}
+	if m.Down == nil {
+		return nil, fmt.Errorf("migration %s (%s) can not be rolled back", m.Version, m.Name)
+	}
+	return m, nil
+}
+
+// 已执行的迁移版本 按版本排序
+func (self *TOrm) MigratedVersions() ([]string, error) {
+	sess := self.NewSession()
+	defer sess.Close()
+
+	if err := sess.createMigrationTable(); err != nil {
+		return nil, err
+	}
+	return sess.appliedVersions()
+}
+
+// 加锁后根据已执行版本获得需执行及回滚的迁移 先回滚后执行
+func (self *TOrm) migrate(plan func(applied []string) (ups, downs []*TMigration, err error)) error {
+	sess := self.NewSession()
+	defer sess.Close()
+
+	if err := sess.createMigrationTable(); err != nil {
+		return err
+	}
+
+	// mysql 的锁属于连接 在独立连接上加锁 事务提交或回滚后才释放
+	lUnlock, err := self.lockMigrationConn()
+	if err != nil {
+		return err
+	}
+	defer lUnlock()
+
+	return sess.transact(func() error {
+		if err := sess.lockMigration(); err != nil {
+			return err
+		}
+
+		// 加锁后读取 其他实例可能已完成迁移
+		lApplied, err := sess.appliedVersions()
+		if err != nil {
+			return err
+		}
+
+		lUps, lDowns, err := plan(lApplied)
+		if err != nil {
+			return err
+		}
+
+		quote := self.Quote
+		for _, m := range lDowns {
+			self.Logger().Infof("Rollback migration %s %s\n", m.Version, m.Name)
+			if err = m.Down(sess); err != nil {
+				return fmt.Errorf("rollback %s (%s): %v", m.Version, m.Name, err)
+			}
+			if _, err = sess.execArgs(fmt.Sprintf("DELETE FROM %s WHERE %s = ?",
+				quote(MigrationTable), quote("version")), m.Version); err != nil {
+				return err
+			}
+		}
+
+		for _, m := range lUps {
+			self.Logger().Infof("Migrate %s %s\n", m.Version, m.Name)
+			if err = m.Up(sess); err != nil {
+				return fmt.Errorf("migrate %s (%s): %v", m.Version, m.Name, err)
+			}
+			if _, err = sess.execArgs(fmt.Sprintf("INSERT INTO %s (%s, %s, %s) VALUES (?, ?, ?)",
+				quote(MigrationTable), quote("version"), quote("name"), quote("applied_at")),
+				m.Version, m.Name, time.Now()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// 创建迁移记录表
+func (self *TOrmSession) createMigrationTable() error {
+	quote := self.Engine.Quote
+	lTimeType := "TIMESTAMP"
+	if self.Engine.Dialect().DBType() == core.MYSQL {
+		lTimeType = "DATETIME"
+	}
+
+	_, err := self.Session.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s VARCHAR(64) NOT NULL PRIMARY KEY, %s VARCHAR(255), %s %s)",
+		quote(MigrationTable), quote("version"), quote("name"), quote("applied_at"), lTimeType))
+	return err
+}
+
+func (self *TOrmSession) appliedVersions() ([]string, error) {
+	quote := self.Engine.Quote
+	ds, err := self.QueryArgs(fmt.Sprintf("SELECT %s FROM %s ORDER BY %s",
+		quote("version"), quote(MigrationTable), quote("version")))
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]string, 0, ds.Count())
+	for _, rec := range ds.Data {
+		res = append(res, rec.Get(0))
+	}
+	return res, nil
+}
+
+// 在事务中获取迁移锁 锁随事务结束释放
+func (self *TOrmSession) lockMigration() (err error) {
+	switch self.Engine.Dialect().DBType() {
+	case core.POSTGRES:
+		_, err = self.QueryArgs("SELECT pg_advisory_xact_lock(?)", int64(migrateLockKey))
+	case core.SQLITE:
+		// 写入使数据库加锁 直到事务结束
+		_, err = self.execArgs(fmt.Sprintf("DELETE FROM %s WHERE 1=0", self.Engine.Quote(MigrationTable)))
+	}
+	return
+}
+
+// mysql 的 GET_LOCK 属于连接 在独立连接上加锁 返回解锁函数
+// 迁移事务提交或回滚后才解锁 避免其他实例读到未提交的迁移记录
+func (self *TOrm) lockMigrationConn() (unlock func(), err error) {
+	unlock = func() {}
+	if self.Engine.Dialect().DBType() != core.MYSQL {
+		return
+	}
+
+	lCtx := context.Background()
+	lConn, err := self.Engine.DB().Conn(lCtx)
+	if err != nil {
+		return
+	}
+
+	var lRes sql.NullInt64
+	err = lConn.QueryRowContext(lCtx, "SELECT GET_LOCK(?, ?)", MigrationTable, migrateLockTimeout).Scan(&lRes)
+	if err == nil && (!lRes.Valid || lRes.Int64 != 1) {
+		err = fmt.Errorf("migrate: timeout waiting for lock %s", MigrationTable)
+	}
+	if err != nil {
+		lConn.Close()
+		return
+	}
+
+	unlock = func() {
+		lConn.ExecContext(lCtx, "SELECT RELEASE_LOCK(?)", MigrationTable)
+		lConn.Close()
+	}
+	return
+}
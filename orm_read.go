@@ -0,0 +1,200 @@
+package orm
+
+/** 按主键读取记录
+one2many 字段对每个字段只执行一次 IN 查询 子记录按关联字段分组后作为子数据集挂到父记录上
+*/
+
+import (
+	"fmt"
+	"strings"
+)
+
+type (
+	// Read 需要读取的字段
+	readPlan struct {
+		cols     []*TField // 数据库字段
+		paths    []string  // 经 many2one 字段的路径 如 partner_id.name
+		o2ms     []*TField // one2many 字段
+		computes []*TField // 不存储的计算字段 依赖在前
+		added    map[string]bool
+	}
+)
+
+// 读取 ids 对应的记录 fields 为空时读取所有字段
+// fields 可以是经 many2one 字段的路径 如 partner_id.name 结果中字段名为该路径
+// one2many 字段的值为 *TDataSet 通过 FieldByName(name).AsDataSet() 获取
+// 关联字段经 Join 读取 不存储的计算字段在读取后计算
+func (self *TOrmSession) Read(model string, ids []interface{}, fields ...string) (*TDataSet, error) {
+	lTable := self.Orm.TableByModel(model)
+	if lTable == nil {
+		return nil, fmt.Errorf("Read: unknown model %s", model)
+	}
+	if lTable.RecordField == nil {
+		return nil, fmt.Errorf("Read: model %s has no record field", model)
+	}
+
+	lPlan, err := lTable.readFields(fields...)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ids) == 0 {
+		ds := NewDataSet()
+		ds.Orm = self.Orm
+		return ds, nil
+	}
+
+	quote := self.Engine.Quote
+	lKey := lTable.RecordField.Name
+	lNames := make([]string, 0, len(lPlan.cols)+len(lPlan.paths))
+	for _, fld := range lPlan.cols {
+		lNames = append(lNames, quote(lTable.Name)+"."+quote(fld.Name))
+	}
+
+	// 路径字段通过 Join 读取
+	lCompiler := newDomainCompiler(self.Orm, lTable)
+	lCompiler.read = true
+	for _, path := range lPlan.paths {
+		lCol, _, _, err := lCompiler.resolve(path)
+		if err != nil {
+			return nil, fmt.Errorf("Read: %v", err)
+		}
+		lNames = append(lNames, lCol+" AS "+quote(path))
+	}
+
+	ds, err := self.QueryArgs(fmt.Sprintf("SELECT %s FROM %s %s WHERE %s.%s IN (%s)",
+		strings.Join(lNames, ","), quote(lTable.Name), strings.Join(lCompiler.query.Joins, " "),
+		quote(lTable.Name), quote(lKey), holders(len(ids))), ids...)
+	if err != nil {
+		return nil, err
+	}
+	ds.KeyField = lKey
+
+	for _, fld := range lPlan.o2ms {
+		if err = self.readOne2Many(ds, lTable, fld, ids); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, fld := range lPlan.computes {
+		for _, rec := range ds.Data {
+			lValue, err := lTable.computeValue(fld, rec)
+			if err != nil {
+				return nil, err
+			}
+			rec.setRaw(fld.Name, lValue)
+		}
+		ds.addFieldSet(fld.Name)
+	}
+	return ds, nil
+}
+
+// 拆分需读取的字段 主键总是被读取
+func (self *TTable) readFields(names ...string) (*readPlan, error) {
+	lPlan := &readPlan{added: make(map[string]bool)}
+	lPlan.cols = append(lPlan.cols, self.RecordField)
+	lPlan.added[self.RecordField.Name] = true
+
+	if len(names) == 0 {
+		for _, fld := range self.Fields {
+			names = append(names, fld.Name)
+		}
+	}
+
+	for _, name := range names {
+		if err := self.planField(lPlan, name); err != nil {
+			return nil, err
+		}
+	}
+	return lPlan, nil
+}
+
+func (self *TTable) planField(plan *readPlan, name string) error {
+	name = strings.TrimSpace(name)
+	if plan.added[name] {
+		return nil
+	}
+	plan.added[name] = true
+
+	if strings.Contains(name, ".") {
+		plan.paths = append(plan.paths, name)
+		return nil
+	}
+
+	fld := self.FieldByColumn(name)
+	if fld == nil {
+		return fmt.Errorf("Read: unknown field %s of %s", name, self.Name)
+	}
+
+	switch {
+	case fld.Type == "one2many":
+		plan.o2ms = append(plan.o2ms, fld)
+	case fld.IsComputed() && !fld.Store:
+		// 先读取依赖
+		for _, dep := range fld.Depends {
+			if err := self.planField(plan, dep); err != nil {
+				return err
+			}
+		}
+		plan.computes = append(plan.computes, fld)
+	case fld.IsRelatedPath():
+		// 关联字段经 Join 读取 列名为字段名
+		plan.paths = append(plan.paths, fld.Name)
+	case fld.Store && !fld.foreign_field:
+		plan.cols = append(plan.cols, fld)
+	}
+	return nil
+}
+
+// 一次读取所有父记录的 one2many 子记录
+func (self *TOrmSession) readOne2Many(ds *TDataSet, table *TTable, field *TField, ids []interface{}) error {
+	lCoTable := self.Orm.TableByModel(field.comodel_name)
+	if lCoTable == nil {
+		return fmt.Errorf("Read: unknown model %s of field %s", field.comodel_name, field.Name)
+	}
+
+	lInverse := field.cokey_field_name
+	if lCoTable.FieldByColumn(lInverse) == nil {
+		return fmt.Errorf("Read: inverse field %s of %s not found in %s", lInverse, field.Name, lCoTable.Name)
+	}
+
+	quote := self.Engine.Quote
+	lOrder := ""
+	if lCoTable.RecordField != nil {
+		lOrder = " ORDER BY " + quote(lCoTable.RecordField.Name)
+	}
+
+	lChildren, err := self.QueryArgs(fmt.Sprintf("SELECT * FROM %s WHERE %s IN (%s)%s",
+		quote(lCoTable.Name), quote(lInverse), holders(len(ids)), lOrder), ids...)
+	if err != nil {
+		return err
+	}
+
+	// 按关联字段分组
+	lGroups := make(map[string]*TDataSet)
+	for _, rec := range lChildren.Data {
+		lParent := itf2Str(rec._getByName(lInverse))
+		lGroup, has := lGroups[lParent]
+		if !has {
+			lGroup = NewDataSet()
+			lGroup.Orm = self.Orm
+			if lCoTable.RecordField != nil {
+				lGroup.KeyField = lCoTable.RecordField.Name
+			}
+			lGroups[lParent] = lGroup
+		}
+		lGroup.appendRecord(rec.Fields, rec.Values)
+	}
+
+	for _, rec := range ds.Data {
+		lGroup, has := lGroups[itf2Str(rec._getByName(table.RecordField.Name))]
+		if !has {
+			lGroup = NewDataSet()
+			lGroup.Orm = self.Orm
+		}
+		rec.setRaw(field.Name, lGroup)
+	}
+
+	ds.addFieldSet(field.Name)
+	return nil
+}
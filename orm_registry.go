@@ -0,0 +1,332 @@
+package orm
+
+/** 多数据库
+TRegistry 按数据库名称缓存 *TOrm 首次使用时按该数据库的配置连接并同步已注册的 Model
+Orm 返回的 release 须在使用完毕后调用 使用中的数据库不会被关闭
+超过 IdleTimeout 未使用的数据库被关闭 再次使用时重新连接
+例如:
+	reg := orm.NewRegistry(&orm.TDbConfig{Type: "postgres", User: "odoo", Password: "odoo", Host: "localhost:5432"})
+	reg.SetConfig("customer_b", &orm.TDbConfig{...})
+	reg.RegisterModel(new(ResPartner), new(ResUsers))
+
+	o, release, err := reg.Orm("customer_a")
+	if err != nil {
+		return err
+	}
+	defer release()
+*/
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"webgo/logger"
+)
+
+type (
+	// 数据库连接配置
+	TDbConfig struct {
+		Type     string // postgres/mysql/sqlite3
+		User     string
+		Password string
+		Host     string   // 主库地址 sqlite3 不使用
+		Replicas []string // 只读库地址 sqlite3 不使用
+		SSLMode  string   // pg:only "require" (default), "verify-full", and "disable" supported
+		DSN      string   // 指定时直接使用该连接字符串 %s 替换为数据库名
+
+		MaxOpenConns    int
+		MaxIdleConns    int
+		ConnMaxLifetime time.Duration
+		ConnectTimeout  time.Duration
+		IdleTimeout     time.Duration // 在 TRegistry 中超过该时间未使用时关闭 0 不关闭
+
+		ShowSql bool // 控制台打印SQL语句
+	}
+
+	TRegistry struct {
+		Default *TDbConfig // 未单独配置的数据库使用的配置
+
+		lock    sync.Mutex
+		configs map[string]*TDbConfig
+		models  []interface{}
+		orms    map[string]*tRegistryItem
+		stop    chan bool
+	}
+
+	tRegistryItem struct {
+		orm      *TOrm
+		config   *TDbConfig
+		lastUsed time.Time
+		refs     int           // 未 release 的使用数
+		retired  bool          // 已从列表移除 使用结束后关闭
+		ready    chan struct{} // 连接及同步完成后关闭
+		err      error         // 连接或同步的错误
+	}
+)
+
+// 空闲数据库的检查间隔
+var RegistryCheckInterval = time.Minute
+
+func NewRegistry(defaultConfig *TDbConfig) *TRegistry {
+	return &TRegistry{
+		Default: defaultConfig,
+		configs: make(map[string]*TDbConfig),
+		orms:    make(map[string]*tRegistryItem),
+	}
+}
+
+// 设置数据库 db 的配置 已连接的数据库在下次使用时以新配置重新连接
+func (self *TRegistry) SetConfig(db string, config *TDbConfig) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.configs[db] = config
+	if lItem, has := self.orms[db]; has {
+		self.retire(db, lItem)
+	}
+}
+
+// 注册 Model 每个数据库首次使用时同步 连接中的数据库在连接完成前同步新注册的 Model
+// 未使用的数据库立即同步 同步期间的使用等待同步完成
+// 使用中的 TOrm 不做修改 该数据库从列表移除 下次使用时重新连接并同步
+func (self *TRegistry) RegisterModel(models ...interface{}) error {
+	self.lock.Lock()
+	lSynced := len(self.models)
+	self.models = append(self.models, models...)
+
+	lItems := make(map[string]*tRegistryItem)
+	lOrms := make(map[string]*TOrm)
+	for db, lItem := range self.orms {
+		if lItem.orm == nil {
+			continue
+		}
+
+		if lItem.refs > 0 {
+			self.retire(db, lItem)
+			continue
+		}
+
+		// 以新的列表项代替 同步完成前的使用等待该项
+		lNew := &tRegistryItem{
+			config:   lItem.config,
+			lastUsed: lItem.lastUsed,
+			ready:    make(chan struct{}),
+		}
+		self.orms[db] = lNew
+		lItems[db] = lNew
+		lOrms[db] = lItem.orm
+	}
+	self.lock.Unlock()
+
+	var err error
+	for db, lItem := range lItems {
+		self.connect(db, lItem, lOrms[db], lSynced)
+		if lItem.err != nil && err == nil {
+			err = lItem.err
+		}
+	}
+	return err
+}
+
+// 数据库 db 的 TOrm 首次使用时连接并同步已注册的 Model
+// 使用完毕后须调用 release 之后不能再使用该 TOrm
+// 连接及同步不占用 TRegistry 的锁 同一数据库的并发请求等待同一连接
+func (self *TRegistry) Orm(db string) (*TOrm, func(), error) {
+	self.lock.Lock()
+	lItem, has := self.orms[db]
+	if !has {
+		lConfig := self.configs[db]
+		if lConfig == nil {
+			lConfig = self.Default
+		}
+		if lConfig == nil {
+			self.lock.Unlock()
+			return nil, nil, fmt.Errorf("registry: no config for database %s", db)
+		}
+
+		lItem = &tRegistryItem{
+			config: lConfig,
+			ready:  make(chan struct{}),
+		}
+		self.orms[db] = lItem
+		go self.connect(db, lItem, nil, 0)
+
+		// 开始检查空闲数据库
+		if lConfig.IdleTimeout > 0 && self.stop == nil {
+			self.stop = make(chan bool)
+			go self.watch(self.stop)
+		}
+	}
+	lItem.refs++
+	lItem.lastUsed = time.Now()
+	self.lock.Unlock()
+
+	<-lItem.ready
+	if lItem.err != nil {
+		self.release(lItem)
+		return nil, nil, lItem.err
+	}
+
+	var lOnce sync.Once
+	return lItem.orm, func() {
+		lOnce.Do(func() { self.release(lItem) })
+	}, nil
+}
+
+// 连接数据库并同步已注册的 Model 同步期间新注册的 Model 继续同步
+// opened 不为空时为已连接的数据库 只同步 synced 之后注册的 Model
+func (self *TRegistry) connect(db string, item *tRegistryItem, opened *TOrm, synced int) {
+	lOrm := opened
+
+	var err error
+	if lOrm == nil {
+		lOrm, err = NewOrmConfig(db, item.config)
+	}
+	for err == nil {
+		self.lock.Lock()
+		lModels := append([]interface{}(nil), self.models[synced:]...)
+		if len(lModels) == 0 {
+			item.orm = lOrm
+			close(item.ready)
+			self.lock.Unlock()
+			return
+		}
+		synced += len(lModels)
+		self.lock.Unlock()
+
+		if _, err = lOrm.SyncModels(lModels...); err != nil {
+			err = fmt.Errorf("sync models of database %s: %v", db, err)
+		}
+	}
+
+	if lOrm != nil {
+		logger.LogErr(lOrm.Close())
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	item.err = err
+	if self.orms[db] == item {
+		delete(self.orms, db)
+	}
+	close(item.ready)
+}
+
+// 结束一次使用 已移除的数据库在最后一次使用结束后关闭
+func (self *TRegistry) release(item *tRegistryItem) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	item.refs--
+	item.lastUsed = time.Now()
+	if item.refs == 0 && item.retired && item.orm != nil {
+		logger.LogErr(item.orm.Close())
+	}
+}
+
+// 从列表移除 无使用时立即关闭 否则在最后一次使用结束后关闭
+// 连接中的数据库由等待该连接的使用者 release 后关闭
+func (self *TRegistry) retire(db string, item *tRegistryItem) {
+	delete(self.orms, db)
+	item.retired = true
+	if item.refs == 0 && item.orm != nil {
+		logger.LogErr(item.orm.Close())
+	}
+}
+
+// 关闭超过 IdleTimeout 未使用的数据库 使用中的数据库不关闭
+func (self *TRegistry) CloseIdle() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	lNow := time.Now()
+	for db, lItem := range self.orms {
+		if lItem.orm != nil && lItem.refs == 0 && lItem.config.IdleTimeout > 0 && lNow.Sub(lItem.lastUsed) > lItem.config.IdleTimeout {
+			logger.Dbg("close idle database:", db)
+			self.retire(db, lItem)
+		}
+	}
+}
+
+// 关闭所有数据库 使用中的数据库在使用结束后关闭
+func (self *TRegistry) Close() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.stop != nil {
+		close(self.stop)
+		self.stop = nil
+	}
+
+	for db, lItem := range self.orms {
+		self.retire(db, lItem)
+	}
+}
+
+func (self *TRegistry) watch(stop chan bool) {
+	lTicker := time.NewTicker(RegistryCheckInterval)
+	defer lTicker.Stop()
+
+	for {
+		select {
+		case <-lTicker.C:
+			self.CloseIdle()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// 连接字符串
+func (self *TDbConfig) dataSource(db, host string) (string, error) {
+	if self.DSN != "" {
+		return strings.Replace(self.DSN, "%s", db, -1), nil
+	}
+
+	switch self.Type {
+	case "mysql":
+		lParams := "charset=utf8&parseTime=true"
+		if self.ConnectTimeout > 0 {
+			lParams += "&timeout=" + self.ConnectTimeout.String()
+		}
+
+		if len(host) > 0 && host[0] == '/' { // looks like a unix socket
+			return fmt.Sprintf("%s:%s@unix(%s)/%s?%s", self.User, self.Password, host, db, lParams), nil
+		}
+		return fmt.Sprintf("%s:%s@tcp(%s)/%s?%s", self.User, self.Password, host, db, lParams), nil
+	case "postgres":
+		lSSLMode := self.SSLMode
+		if lSSLMode == "" {
+			lSSLMode = "require"
+		}
+
+		lCnnstr := fmt.Sprintf("postgres://%s:%s@%s/%s?sslmode=%s",
+			url.QueryEscape(self.User), url.QueryEscape(self.Password), host, db, lSSLMode)
+		if self.ConnectTimeout > 0 {
+			lCnnstr += "&connect_timeout=" + strconv.Itoa(int(self.ConnectTimeout/time.Second))
+		}
+		return lCnnstr, nil
+	case "sqlite3":
+		// 数据库名为文件路径 为空或 :memory: 时使用内存数据库
+		// 驱动默认不检查外键 需在每个连接上开启
+		lParams := "_foreign_keys=1"
+		if self.ConnectTimeout > 0 {
+			lParams += "&_busy_timeout=" + strconv.Itoa(int(self.ConnectTimeout/time.Millisecond))
+		}
+
+		if isMemoryDb(db) {
+			return "file::memory:?cache=shared&" + lParams, nil
+		}
+		return "file:" + db + "?" + lParams, nil
+	}
+	return "", fmt.Errorf("Unknown database type: %s", self.Type)
+}
+
+// sqlite3 的内存数据库
+func isMemoryDb(db string) bool {
+	return db == "" || db == ":memory:"
+}
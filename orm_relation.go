@@ -0,0 +1,179 @@
+package orm
+
+/** many2many 关系表
+many2many(关联表,关系表,该Model的字段,关联表的字段)
+关系表包含两个关键字段 两字段组合唯一 并分别以外键关联两边的主键 删除任一边记录时级联删除关系
+*/
+
+import (
+	"fmt"
+	"webgo/logger"
+
+	core "github.com/go-xorm/core"
+)
+
+// 计划创建与 table 相关且两边 Model 都已映射的 many2many 关系表
+func (self *TOrm) planMany2Many(plan *TSyncPlan, table *TTable) error {
+	for _, tbl := range self.allTables() {
+		for _, name := range sortedFields(tbl) {
+			fld := tbl.Fields[name]
+			if fld.Type != "many2many" {
+				continue
+			}
+
+			lCoTable := self.TableByModel(fld.comodel_name)
+			if tbl != table && lCoTable != table {
+				continue
+			}
+
+			// 关联的Model 尚未同步 待其同步时创建
+			if lCoTable == nil {
+				logger.Dbg("many2many postponed:", tbl.Name, fld.Name, fld.comodel_name)
+				continue
+			}
+
+			if err := self.planRelTable(plan, tbl, lCoTable, fld); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// 关系表不存在时创建
+func (self *TOrm) planRelTable(plan *TSyncPlan, table, coTable *TTable, field *TField) error {
+	if table.RecordField == nil || coTable.RecordField == nil {
+		return fmt.Errorf("many2many field %s of %s: both models need a record field", field.Name, table.Name)
+	}
+
+	lRelName := modelTableName(field.relmodel_name)
+	if plan.tables[lRelName] {
+		return nil
+	}
+	has, err := self.IsTableExist(lRelName)
+	if err != nil || has {
+		return err
+	}
+	plan.tables[lRelName] = true
+
+	quote := self.Quote
+	lKey, lRelKey := field.cokey_field_name, field.relkey_field_name
+	lSql := fmt.Sprintf("CREATE TABLE %s (%s %s NOT NULL, %s %s NOT NULL, "+
+		"CONSTRAINT %s FOREIGN KEY (%s) REFERENCES %s (%s) ON DELETE CASCADE, "+
+		"CONSTRAINT %s FOREIGN KEY (%s) REFERENCES %s (%s) ON DELETE CASCADE)",
+		quote(lRelName),
+		quote(lKey), self.keyColumnType(table),
+		quote(lRelKey), self.keyColumnType(coTable),
+		quote(fmt.Sprintf("FK_%s_%s", lRelName, lKey)), quote(lKey), quote(table.Name), quote(table.RecordField.Name),
+		quote(fmt.Sprintf("FK_%s_%s", lRelName, lRelKey)), quote(lRelKey), quote(coTable.Name), quote(coTable.RecordField.Name))
+	plan.add(lRelName, lSql, "new many2many relation table of %s.%s", table.Name, field.Name)
+
+	lIndex := core.NewIndex(lKey+"_"+lRelKey, core.UniqueType)
+	lIndex.AddColumn(lKey, lRelKey)
+	plan.add(lRelName, self.Dialect().CreateIndexSql(lRelName, lIndex), "new unique %s", lIndex.Name)
+	return nil
+}
+
+// 引用 table 主键的字段类型
+func (self *TOrm) keyColumnType(table *TTable) string {
+	if lOrgTable := self.orgTable(table._cls_type); lOrgTable != nil {
+		if col := lOrgTable.GetColumn(table.RecordField.Name); col != nil {
+			lCol := *col
+			lCol.IsPrimaryKey = false
+			lCol.IsAutoIncrement = false
+			return self.Dialect().SqlType(&lCol)
+		}
+	}
+	return self.Dialect().SqlType(&core.Column{SQLType: core.SQLType{core.BigInt, 0, 0}})
+}
+
+// 为当前记录添加 many2many 关联
+// 例如: orm.NewSession().Table("res_users").Id(1).Link("group_ids", 2, 3)
+func (self *TOrmSession) Link(field string, ids ...interface{}) error {
+	return self.relate(field, false, ids...)
+}
+
+// 删除当前记录的 many2many 关联
+func (self *TOrmSession) Unlink(field string, ids ...interface{}) error {
+	lRel, lKey, lRelKey, lId, err := self.relField(field)
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+
+	quote := self.Engine.Quote
+	_, err = self.execArgs(fmt.Sprintf("DELETE FROM %s WHERE %s = ? AND %s IN (%s)",
+		quote(lRel), quote(lKey), quote(lRelKey), holders(len(ids))), append([]interface{}{lId}, ids...)...)
+	return err
+}
+
+// 以 ids 替换当前记录所有 many2many 关联
+func (self *TOrmSession) Replace(field string, ids ...interface{}) error {
+	return self.relate(field, true, ids...)
+}
+
+func (self *TOrmSession) relate(field string, replace bool, ids ...interface{}) error {
+	lRel, lKey, lRelKey, lId, err := self.relField(field)
+	if err != nil {
+		return err
+	}
+
+	quote := self.Engine.Quote
+	return self.transact(func() error {
+		if replace {
+			if _, err := self.execArgs(fmt.Sprintf("DELETE FROM %s WHERE %s = ?",
+				quote(lRel), quote(lKey)), lId); err != nil {
+				return err
+			}
+		}
+
+		// 已存在的关联不重复添加
+		lExists := make(map[string]bool)
+		if !replace && len(ids) > 0 {
+			ds, err := self.QueryArgs(fmt.Sprintf("SELECT %s FROM %s WHERE %s = ? AND %s IN (%s)",
+				quote(lRelKey), quote(lRel), quote(lKey), quote(lRelKey), holders(len(ids))),
+				append([]interface{}{lId}, ids...)...)
+			if err != nil {
+				return err
+			}
+			for _, rec := range ds.Data {
+				lExists[itf2Str(rec.Value(0))] = true
+			}
+		}
+
+		for _, id := range ids {
+			if lExists[itf2Str(id)] {
+				continue
+			}
+			lExists[itf2Str(id)] = true
+
+			if _, err := self.execArgs(fmt.Sprintf("INSERT INTO %s (%s, %s) VALUES (?, ?)",
+				quote(lRel), quote(lKey), quote(lRelKey)), lId, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// 会话当前表及记录对应的 many2many 关系表信息
+func (self *TOrmSession) relField(field string) (rel, key, relKey string, id interface{}, err error) {
+	defer self.resetStatement()
+
+	lTableName := self.Statement.TableName()
+	lTable := self.Orm.TableByName(lTableName)
+	if lTable == nil {
+		return "", "", "", nil, fmt.Errorf("unknown table %s", lTableName)
+	}
+
+	lField := lTable.FieldByColumn(field)
+	if lField == nil || lField.Type != "many2many" {
+		return "", "", "", nil, fmt.Errorf("field %s of %s is not a many2many field", field, lTableName)
+	}
+
+	if self.Statement.IdParam == nil || len(*self.Statement.IdParam) == 0 {
+		return "", "", "", nil, fmt.Errorf("many2many %s of %s: no record id, use Id() first", field, lTableName)
+	}
+
+	return modelTableName(lField.relmodel_name), lField.cokey_field_name, lField.relkey_field_name,
+		(*self.Statement.IdParam)[0], nil
+}
@@ -0,0 +1,258 @@
+package orm
+
+/** 读写分离
+TOrm 包含一个主库及多个只读库 只读库由 TDbConfig.Replicas 指定或通过 AddReplica 添加
+SqlQuery/Query/QueryArgs 及会话的 Find/Get/Count/FindAndCount/Iterate/Sum 等读取轮流在只读库执行
+TOrm 的 Where/Id/In/Sql 等返回自动关闭的会话 Find/Get/Count 等在新会话中执行 同样使用只读库
+Rows 返回的结果集依赖会话的连接 总在主库执行
+写入 ForUpdate 及事务中的所有操作在主库执行
+只读库查询失败且无法连接时 暂停使用 ReplicaRetry 时间并改在主库执行
+会话 UseMaster() 后所有读取在主库执行 用于读取刚写入的数据
+*/
+
+import (
+	"sync/atomic"
+	"time"
+	"webgo/logger"
+
+	core "github.com/go-xorm/core"
+	orm "github.com/go-xorm/xorm"
+)
+
+// 故障只读库暂停使用的时间
+var ReplicaRetry = 30 * time.Second
+
+type (
+	tReplica struct {
+		*orm.Engine
+		Host      string
+		downUntil int64 // 暂停使用直到该时间 UnixNano
+	}
+)
+
+// 添加只读库 使用与主库相同的数据库名
+func (self *TOrm) AddReplica(host string) error {
+	lEngine, err := newEngine(self.config, self.dbName, host)
+	if err != nil {
+		return err
+	}
+
+	self.modelLock.Lock()
+	defer self.modelLock.Unlock()
+
+	// 使用主库已映射的 Model
+	for t, tb := range self.Engine.Tables {
+		lEngine.Tables[t] = tb
+	}
+
+	self.replicas = append(self.replicas, &tReplica{Engine: lEngine, Host: host})
+	return nil
+}
+
+// 轮流选择可用的只读库 无可用只读库时返回 nil
+func (self *TOrm) replica() *tReplica {
+	self.modelLock.RLock()
+	defer self.modelLock.RUnlock()
+
+	lCount := len(self.replicas)
+	lNow := time.Now().UnixNano()
+	for i := 0; i < lCount; i++ {
+		lReplica := self.replicas[int(atomic.AddUint32(&self.replicaNext, 1)%uint32(lCount))]
+		if atomic.LoadInt64(&lReplica.downUntil) <= lNow {
+			return lReplica
+		}
+	}
+	return nil
+}
+
+// 查询出错后检查只读库 无法连接时暂停使用并返回 true
+func (self *TOrm) replicaFailed(replica *tReplica) bool {
+	if err := replica.DB().Ping(); err == nil {
+		return false
+	}
+
+	logger.Logger.Error("replica %s is down, retry after %v", replica.Host, ReplicaRetry)
+	atomic.StoreInt64(&replica.downUntil, time.Now().Add(ReplicaRetry).UnixNano())
+	return true
+}
+
+// 在只读库执行查询 无可用只读库或只读库故障时在主库执行
+func (self *TOrm) queryRows(sql string, args ...interface{}) (*core.Rows, error) {
+	if lReplica := self.replica(); lReplica != nil {
+		lRows, err := lReplica.DB().Query(sql, args...)
+		if err == nil || !self.replicaFailed(lReplica) {
+			return lRows, err
+		}
+	}
+	return self.Engine.DB().Query(sql, args...)
+}
+
+// 关闭主库及所有只读库
+func (self *TOrm) Close() error {
+	self.modelLock.RLock()
+	defer self.modelLock.RUnlock()
+
+	for _, lReplica := range self.replicas {
+		logger.LogErr(lReplica.Close())
+	}
+	return self.Engine.Close()
+}
+
+// 之后的所有读取在主库执行
+func (self *TOrmSession) UseMaster() *TOrmSession {
+	self.useMaster = true
+	return self
+}
+
+// 读取是否必须在主库执行
+func (self *TOrmSession) onMaster() bool {
+	return self.useMaster || self.Statement.IsForUpdate || (!self.IsAutoCommit && self.Tx != nil)
+}
+
+// 执行查询 只读库故障时在主库执行
+func (self *TOrmSession) queryRows(sql string, args ...interface{}) (*core.Rows, error) {
+	if self.onMaster() {
+		if self.Tx != nil {
+			return self.Tx.Query(sql, args...)
+		}
+		return self.Engine.DB().Query(sql, args...)
+	}
+	return self.Orm.queryRows(sql, args...)
+}
+
+// 以当前条件在只读库执行 fn 只读库故障时在主库执行
+func (self *TOrmSession) read(fn func(sess *orm.Session) error) error {
+	defer self.clearCols()
+
+	if !self.onMaster() {
+		if lReplica := self.Orm.replica(); lReplica != nil {
+			lSess := &orm.Session{Engine: lReplica.Engine}
+			lSess.Init()
+			lSess.Statement = self.Statement
+			lSess.Statement.Engine = lReplica.Engine
+
+			err := fn(lSess)
+			lSess.Close()
+			if err == nil || !self.Orm.replicaFailed(lReplica) {
+				self.resetStatement()
+				if self.IsAutoClose {
+					self.Close()
+				}
+				return err
+			}
+		}
+	}
+	return fn(self.Session)
+}
+
+func (self *TOrmSession) Find(rowsSlicePtr interface{}, condiBean ...interface{}) error {
+	return self.read(func(sess *orm.Session) error {
+		return sess.Find(rowsSlicePtr, condiBean...)
+	})
+}
+
+func (self *TOrmSession) Get(bean interface{}) (has bool, err error) {
+	err = self.read(func(sess *orm.Session) error {
+		has, err = sess.Get(bean)
+		return err
+	})
+	return
+}
+
+func (self *TOrmSession) Count(bean interface{}) (cnt int64, err error) {
+	err = self.read(func(sess *orm.Session) error {
+		cnt, err = sess.Count(bean)
+		return err
+	})
+	return
+}
+
+func (self *TOrmSession) FindAndCount(rowsSlicePtr interface{}, condiBean ...interface{}) (cnt int64, err error) {
+	err = self.read(func(sess *orm.Session) error {
+		cnt, err = sess.FindAndCount(rowsSlicePtr, condiBean...)
+		return err
+	})
+	return
+}
+
+func (self *TOrmSession) Iterate(bean interface{}, fun orm.IterFunc) error {
+	return self.read(func(sess *orm.Session) error {
+		return sess.Iterate(bean, fun)
+	})
+}
+
+func (self *TOrmSession) Sum(bean interface{}, colName string) (res float64, err error) {
+	err = self.read(func(sess *orm.Session) error {
+		res, err = sess.Sum(bean, colName)
+		return err
+	})
+	return
+}
+
+// 结果集使用会话的连接 在主库执行
+func (self *TOrmSession) Rows(bean interface{}) (*orm.Rows, error) {
+	defer self.clearCols()
+	return self.Session.Rows(bean)
+}
+
+// 以下为 TOrm 的读取 在新会话中执行以使用只读库 See TOrmSession.read()
+
+func (self *TOrm) Where(querystring string, args ...interface{}) *TOrmSession {
+	session := self.NewSession()
+	session.IsAutoClose = true
+	return session.Where(querystring, args...)
+}
+
+func (self *TOrm) Id(id interface{}) *TOrmSession {
+	session := self.NewSession()
+	session.IsAutoClose = true
+	return session.Id(id)
+}
+
+func (self *TOrm) In(column string, args ...interface{}) *TOrmSession {
+	session := self.NewSession()
+	session.IsAutoClose = true
+	return session.In(column, args...)
+}
+
+func (self *TOrm) Sql(querystring string, args ...interface{}) *TOrmSession {
+	session := self.NewSession()
+	session.IsAutoClose = true
+	return session.Sql(querystring, args...)
+}
+
+func (self *TOrm) Find(rowsSlicePtr interface{}, condiBean ...interface{}) error {
+	session := self.NewSession()
+	defer session.Close()
+	return session.Find(rowsSlicePtr, condiBean...)
+}
+
+func (self *TOrm) Get(bean interface{}) (bool, error) {
+	session := self.NewSession()
+	defer session.Close()
+	return session.Get(bean)
+}
+
+func (self *TOrm) Count(bean interface{}) (int64, error) {
+	session := self.NewSession()
+	defer session.Close()
+	return session.Count(bean)
+}
+
+func (self *TOrm) FindAndCount(rowsSlicePtr interface{}, condiBean ...interface{}) (int64, error) {
+	session := self.NewSession()
+	defer session.Close()
+	return session.FindAndCount(rowsSlicePtr, condiBean...)
+}
+
+func (self *TOrm) Iterate(bean interface{}, fun orm.IterFunc) error {
+	session := self.NewSession()
+	defer session.Close()
+	return session.Iterate(bean, fun)
+}
+
+func (self *TOrm) Sum(bean interface{}, colName string) (float64, error) {
+	session := self.NewSession()
+	defer session.Close()
+	return session.Sum(bean, colName)
+}
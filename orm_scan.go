@@ -0,0 +1,190 @@
+package orm
+
+/** 记录映射到Model
+通过 mapType 生成的 TTable 将数据库字段名映射回 Model 成员 包括 name(...) 重命名及 extends/relate 继承的成员
+*/
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// 将记录的值写入 model 指针指向的结构
+func (self *TRecordSet) ScanStruct(model interface{}) error {
+	lValue := reflect.ValueOf(model)
+	if lValue.Kind() != reflect.Ptr || lValue.IsNil() || lValue.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("ScanStruct: model must be a pointer to struct, got %T", model)
+	}
+
+	lTable, err := self.DataSet.modelTable(lValue.Elem().Type())
+	if err != nil {
+		return err
+	}
+
+	return self.scanStruct(lTable, lValue.Elem())
+}
+
+func (self *TRecordSet) scanStruct(table *TTable, value reflect.Value) error {
+	for idx, name := range self.Fields {
+		lField := table.FieldByColumn(name)
+		if lField == nil || len(lField.member_index) == 0 {
+			continue
+		}
+
+		lMember := fieldByIndexAlloc(value, lField.member_index)
+		if !lMember.CanSet() {
+			continue
+		}
+
+		if err := setValue(lMember, self.Values[idx]); err != nil {
+			return fmt.Errorf("ScanStruct: %s.%s: %v", table.Name, name, err)
+		}
+	}
+	return nil
+}
+
+// 将所有记录写入 models 指向的切片 元素可以是结构或结构指针
+// 流式数据集从当前位置读取到结束
+func (self *TDataSet) ScanAll(models interface{}) error {
+	lSlice := reflect.ValueOf(models)
+	if lSlice.Kind() != reflect.Ptr || lSlice.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("ScanAll: models must be a pointer to slice, got %T", models)
+	}
+	lSlice = lSlice.Elem()
+
+	lElemType := lSlice.Type().Elem()
+	lIsPtr := lElemType.Kind() == reflect.Ptr
+	if lIsPtr {
+		lElemType = lElemType.Elem()
+	}
+	if lElemType.Kind() != reflect.Struct {
+		return fmt.Errorf("ScanAll: slice element must be a struct, got %v", lElemType)
+	}
+
+	lTable, err := self.modelTable(lElemType)
+	if err != nil {
+		return err
+	}
+
+	lScan := func(rec *TRecordSet) error {
+		lNew := reflect.New(lElemType)
+		if err := rec.scanStruct(lTable, lNew.Elem()); err != nil {
+			return err
+		}
+
+		if lIsPtr {
+			lSlice.Set(reflect.Append(lSlice, lNew))
+		} else {
+			lSlice.Set(reflect.Append(lSlice, lNew.Elem()))
+		}
+		return nil
+	}
+
+	if self.IsStream() {
+		for ; !self.Eof(); self.Next() {
+			if err = lScan(self.Record()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, rec := range self.Data {
+		if err = lScan(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Model 对应的表信息 Model 必须已经 SyncModel
+func (self *TDataSet) modelTable(t reflect.Type) (*TTable, error) {
+	if self.Orm == nil {
+		return nil, fmt.Errorf("dataset is not bound to an orm")
+	}
+
+	lTable := self.Orm.TableByType(t)
+	if lTable == nil {
+		return nil, fmt.Errorf("model %v is not mapped, call SyncModel first", t)
+	}
+	return lTable, nil
+}
+
+// 按索引路径获取成员 途经的nil指针自动分配
+func fieldByIndexAlloc(value reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i > 0 && value.Kind() == reflect.Ptr {
+			if value.IsNil() {
+				value.Set(reflect.New(value.Type().Elem()))
+			}
+			value = value.Elem()
+		}
+		value = value.Field(x)
+	}
+	return value
+}
+
+// 将原始类型的值转换为成员类型并赋值 NULL 赋零值
+func setValue(dst reflect.Value, src interface{}) error {
+	if src == nil {
+		dst.Set(reflect.Zero(dst.Type()))
+		return nil
+	}
+
+	if scanner, ok := dst.Addr().Interface().(sql.Scanner); ok {
+		return scanner.Scan(src)
+	}
+
+	if dst.Kind() == reflect.Ptr {
+		lNew := reflect.New(dst.Type().Elem())
+		if err := setValue(lNew.Elem(), src); err != nil {
+			return err
+		}
+		dst.Set(lNew)
+		return nil
+	}
+
+	switch dst.Kind() {
+	case reflect.String:
+		dst.SetString(itf2Str(src))
+		return nil
+	case reflect.Bool:
+		dst.SetBool(itf2Bool(src))
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		dst.SetInt(itf2Int(src))
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		dst.SetUint(uint64(itf2Int(src)))
+		return nil
+	case reflect.Float32, reflect.Float64:
+		dst.SetFloat(itf2Float(src))
+		return nil
+	case reflect.Struct:
+		if dst.Type().ConvertibleTo(reflect.TypeOf(time.Time{})) {
+			dst.Set(reflect.ValueOf(itf2Time(src)).Convert(dst.Type()))
+			return nil
+		}
+	case reflect.Slice:
+		if dst.Type().Elem().Kind() == reflect.Uint8 {
+			dst.SetBytes([]byte(itf2Str(src)))
+			return nil
+		}
+	}
+
+	lSrc := reflect.ValueOf(src)
+	if lSrc.Type().ConvertibleTo(dst.Type()) {
+		dst.Set(lSrc.Convert(dst.Type()))
+		return nil
+	}
+
+	// json 字段
+	switch src.(type) {
+	case string, []byte:
+		return json.Unmarshal([]byte(itf2Str(src)), dst.Addr().Interface())
+	}
+	return fmt.Errorf("cannot convert %T to %v", src, dst.Type())
+}
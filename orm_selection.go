@@ -0,0 +1,454 @@
+package orm
+
+/** 选择字段
+选项按声明顺序保存为 (值, 标签) 列表 来源可以是:
+	JSON 数组 selection([["draft","Draft"],["done","Done"]]) 或 selection(["draft","Draft","done","Done"])
+	JSON 对象 selection({"draft":"Draft","done":"Done"}) 按对象中的顺序
+	Model 方法 selection(StateSelection) 返回 TSelection [][2]string 或 map[string]interface{}(按值排序)
+Create/Write/ApplyUpdates 拒绝不在选项中的值 空值由 required 控制 See _Validate()
+enforce(check) 同步时创建 CHECK 约束 enforce(enum) 在 postgres 上使用 ENUM 类型 其他数据库使用 CHECK
+约束及类型名称包含选项的摘要 选项改变时替换原约束或类型
+例如:
+	State string `field:"selection({\"draft\":\"Draft\",\"done\":\"Done\"}) enforce(check) default('draft')"`
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"reflect"
+	"sort"
+	"strings"
+	"webgo/utils"
+
+	core "github.com/go-xorm/core"
+)
+
+type (
+	// 选项
+	TSelectionItem struct {
+		Value string
+		Label string
+	}
+
+	// 按声明顺序的选项
+	TSelection []*TSelectionItem
+)
+
+// 所有选项的值
+func (self TSelection) Values() []string {
+	res := make([]string, 0, len(self))
+	for _, item := range self {
+		res = append(res, item.Value)
+	}
+	return res
+}
+
+// 值对应的标签 不存在时返回空
+func (self TSelection) Label(value string) string {
+	for _, item := range self {
+		if item.Value == value {
+			return item.Label
+		}
+	}
+	return ""
+}
+
+func (self TSelection) Has(value string) bool {
+	for _, item := range self {
+		if item.Value == value {
+			return true
+		}
+	}
+	return false
+}
+
+// 以 [值, 标签] 数组输出 保持顺序
+func (self *TSelectionItem) MarshalJSON() ([]byte, error) {
+	return json.Marshal([2]string{self.Value, self.Label})
+}
+
+// 选项摘要 用于约束及类型名称
+func (self TSelection) digest() string {
+	lHash := fnv.New32a()
+	for _, item := range self {
+		lHash.Write([]byte(item.Value))
+		lHash.Write([]byte{0})
+	}
+	return fmt.Sprintf("%08x", lHash.Sum32())
+}
+
+// 从 JSON 数组或对象解析选项
+func parseSelection(str string) (TSelection, error) {
+	str = strings.TrimSpace(str)
+	if strings.HasPrefix(str, "{") {
+		return parseSelectionObject(str)
+	}
+
+	var lList []interface{}
+	if err := json.Unmarshal([]byte(str), &lList); err != nil {
+		return nil, err
+	}
+
+	res := make(TSelection, 0, len(lList))
+	for idx := 0; idx < len(lList); idx++ {
+		if lPair, ok := lList[idx].([]interface{}); ok {
+			if len(lPair) != 2 {
+				return nil, fmt.Errorf("selection item %d must be a [value, label] pair", idx)
+			}
+			res = append(res, &TSelectionItem{Value: itf2Str(lPair[0]), Label: itf2Str(lPair[1])})
+			continue
+		}
+
+		// 值与标签交替
+		if idx+1 >= len(lList) {
+			return nil, fmt.Errorf("selection value %v has no label", lList[idx])
+		}
+		res = append(res, &TSelectionItem{Value: itf2Str(lList[idx]), Label: itf2Str(lList[idx+1])})
+		idx++
+	}
+	return res, nil
+}
+
+// 按对象中键的顺序解析
+func parseSelectionObject(str string) (TSelection, error) {
+	lDecoder := json.NewDecoder(bytes.NewReader([]byte(str)))
+	lDecoder.UseNumber()
+	if _, err := lDecoder.Token(); err != nil { // {
+		return nil, err
+	}
+
+	res := make(TSelection, 0)
+	for lDecoder.More() {
+		lKey, err := lDecoder.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		var lLabel interface{}
+		if err = lDecoder.Decode(&lLabel); err != nil {
+			return nil, err
+		}
+		res = append(res, &TSelectionItem{Value: itf2Str(lKey), Label: itf2Str(lLabel)})
+	}
+
+	if _, err := lDecoder.Token(); err != nil { // }
+		return nil, err
+	}
+	return res, nil
+}
+
+// 方法返回的选项
+func selectionOf(result interface{}) (TSelection, bool) {
+	switch v := result.(type) {
+	case TSelection:
+		return v, true
+	case [][2]string:
+		res := make(TSelection, 0, len(v))
+		for _, pair := range v {
+			res = append(res, &TSelectionItem{Value: pair[0], Label: pair[1]})
+		}
+		return res, true
+	case map[string]interface{}:
+		// map 无顺序 按值排序
+		lKeys := sortedKeys(v)
+		res := make(TSelection, 0, len(lKeys))
+		for _, key := range lKeys {
+			res = append(res, &TSelectionItem{Value: key, Label: itf2Str(v[key])})
+		}
+		return res, true
+	}
+	return nil, false
+}
+
+// 调用 Model 的选项方法 方法无参数或以 Model 为参数
+func callSelection(model reflect.Value, name string) (TSelection, bool, error) {
+	lMethod := reflect.New(model.Type()).MethodByName(name)
+	if !lMethod.IsValid() {
+		return nil, false, nil
+	}
+
+	var lResults []reflect.Value
+	switch {
+	case lMethod.Type().NumIn() == 0:
+		lResults = lMethod.Call(nil)
+	case lMethod.Type().NumIn() == 1 && model.Type().AssignableTo(lMethod.Type().In(0)):
+		lResults = lMethod.Call([]reflect.Value{model})
+	default:
+		return nil, true, fmt.Errorf("selection method %s must take no arguments or the model", name)
+	}
+
+	if len(lResults) == 1 {
+		if res, ok := selectionOf(lResults[0].Interface()); ok {
+			return res, true, nil
+		}
+	}
+	return nil, true, fmt.Errorf("selection method %s must return TSelection, [][2]string or map[string]interface{}", name)
+}
+
+// 检查写入选择字段的值 空值不检查
+func (self *TField) checkSelection(value interface{}) error {
+	if self.Type != "selection" || self.Selection == nil {
+		return nil
+	}
+
+	lValue := itf2Str(indirectValue(value))
+	if lValue == "" || self.Selection.Has(lValue) {
+		return nil
+	}
+	return fmt.Errorf("value %q of selection field %s is not one of %s", lValue, self.Name, strings.Join(self.Selection.Values(), ", "))
+}
+
+// 存储于数据库的选择字段
+func (self *TTable) storedSelections() []*TField {
+	res := make([]*TField, 0)
+	for _, name := range sortedFields(self) {
+		if fld := self.Fields[name]; fld.Type == "selection" && fld.Store && !fld.foreign_field && fld.Selection != nil {
+			res = append(res, fld)
+		}
+	}
+	return res
+}
+
+// 字段的约束方式 enum 只支持 postgres 其他数据库改用 check
+func (self *TOrm) enforceOf(field *TField) string {
+	if field.enforce == "enum" && self.Dialect().DBType() != core.POSTGRES {
+		return "check"
+	}
+	return field.enforce
+}
+
+// 数据库对象名称的最大长度 postgres 截断超过 63 字节的名称 mysql 不允许超过 64
+const maxNameLen = 63
+
+// 约束名称及类型名称的前缀 其后为 8 位选项摘要
+func selectionCheckName(table, column string) string {
+	return selectionName("CK_", table, column)
+}
+
+func selectionEnumName(table, column string) string {
+	return strings.ToLower(selectionName("", table, column))
+}
+
+// 名称超长时截断表名及字段名部分 并以表名及字段名的摘要保持唯一
+func selectionName(prefix, table, column string) string {
+	lName := prefix + table + "_" + column + "_"
+	if len(lName)+8 <= maxNameLen {
+		return lName
+	}
+
+	lHash := fnv.New32a()
+	lHash.Write([]byte(table + "." + column))
+	lTail := fmt.Sprintf("_%08x_", lHash.Sum32())
+	return lName[:maxNameLen-8-len(lTail)] + lTail
+}
+
+// 是否为前缀 prefix 加选项摘要的名称 避免字段 a 匹配字段 a_b 的名称
+func isSelectionName(name, prefix string) bool {
+	return len(name) == len(prefix)+8 && strings.HasPrefix(name, prefix)
+}
+
+// 以 SQL 字符串列出选项
+func (self TSelection) sqlList() string {
+	lValues := make([]string, 0, len(self))
+	for _, item := range self {
+		lValues = append(lValues, "'"+strings.Replace(item.Value, "'", "''", -1)+"'")
+	}
+	return strings.Join(lValues, ", ")
+}
+
+// CHECK 约束的定义
+func (self *TOrm) selectionCheck(table string, field *TField) (name, sql string) {
+	name = selectionCheckName(table, field.Name) + field.Selection.digest()
+	return name, fmt.Sprintf("CONSTRAINT %s CHECK (%s IN (%s))", self.Quote(name), self.Quote(field.Name), field.Selection.sqlList())
+}
+
+// 建表时创建的 CHECK 约束 用于 sqlite
+func (self *TOrm) inlineChecks(table *TTable) (res []string) {
+	for _, fld := range table.storedSelections() {
+		if self.enforceOf(fld) == "check" {
+			_, lSql := self.selectionCheck(table.Name, fld)
+			res = append(res, lSql)
+		}
+	}
+	return
+}
+
+// 使用 ENUM 类型的字段不比较类型及默认值 See planSelections()
+func (self *TOrm) isEnumColumn(table *core.Table, column string) bool {
+	lTable := self.TableByType(table.Type)
+	if lTable == nil {
+		return false
+	}
+	lField := lTable.FieldByColumn(column)
+	return lField != nil && lField.Type == "selection" && self.enforceOf(lField) == "enum"
+}
+
+// 同步选择字段的 CHECK 约束及 ENUM 类型 选项改变时替换 不再约束时删除
+func (self *TOrm) planSelections(plan *TSyncPlan, table *TTable) error {
+	lFields := table.storedSelections()
+	if len(lFields) == 0 {
+		return nil
+	}
+
+	switch self.Dialect().DBType() {
+	case core.POSTGRES, core.MYSQL:
+	case core.SQLITE:
+		// 约束在建表或重建表时创建
+		return self.noteSqliteChecks(plan, table)
+	default:
+		plan.warn("Table %s selection constraints are not supported on %s", table.Name, self.DriverName())
+		return nil
+	}
+
+	// 计划中新建的表无约束
+	lChecks, lEnums := make([]string, 0), make([]string, 0)
+	if !plan.tables[table.Name] {
+		var err error
+		if lChecks, err = self.checkConstraints(table.Name); err != nil {
+			return err
+		}
+		if self.Dialect().DBType() == core.POSTGRES {
+			if lEnums, err = self.enumTypes(table.Name); err != nil {
+				return err
+			}
+		}
+	}
+
+	quote := self.Quote
+	for _, fld := range lFields {
+		lEnforce := self.enforceOf(fld)
+
+		// 删除选项改变或不再需要的约束
+		lCheck, lCheckSql := self.selectionCheck(table.Name, fld)
+		for _, name := range lChecks {
+			if isSelectionName(name, selectionCheckName(table.Name, fld.Name)) && (lEnforce != "check" || name != lCheck) {
+				lSql := fmt.Sprintf("ALTER TABLE %s DROP CONSTRAINT %s", quote(table.Name), quote(name))
+				if self.Dialect().DBType() == core.MYSQL {
+					lSql = fmt.Sprintf("ALTER TABLE %s DROP CHECK %s", quote(table.Name), quote(name))
+				}
+				plan.add(table.Name, lSql, "selection %s check %s dropped: options changed", fld.Name, name)
+			}
+		}
+		if lEnforce == "check" && !utils.InStrings(lCheck, lChecks...) {
+			plan.add(table.Name, fmt.Sprintf("ALTER TABLE %s ADD %s", quote(table.Name), lCheckSql),
+				"selection %s check %s", fld.Name, lCheck)
+		}
+
+		if self.Dialect().DBType() == core.POSTGRES {
+			self.planEnum(plan, table, fld, lEnums)
+		}
+	}
+	return nil
+}
+
+// postgres ENUM 类型 选项改变时以新类型替换 原类型在字段转换后删除
+func (self *TOrm) planEnum(plan *TSyncPlan, table *TTable, field *TField, exists []string) {
+	quote := self.Quote
+	lPrefix := selectionEnumName(table.Name, field.Name)
+	lEnum := ""
+	if self.enforceOf(field) == "enum" {
+		lEnum = lPrefix + field.Selection.digest()
+	}
+
+	lOld := make([]string, 0)
+	for _, name := range exists {
+		if isSelectionName(name, lPrefix) && name != lEnum {
+			lOld = append(lOld, name)
+		}
+	}
+	if utils.InStrings(lEnum, exists...) || (lEnum == "" && len(lOld) == 0) {
+		return
+	}
+
+	var lCol *core.Column
+	if lOrgTable := self.orgTable(table._cls_type); lOrgTable != nil {
+		lCol = lOrgTable.GetColumn(field.Name)
+	}
+
+	lType := "TEXT"
+	if lCol != nil {
+		lType = self.Dialect().SqlType(lCol)
+	}
+
+	// 原默认值无法自动转换为新类型
+	lDefault := ""
+	if lCol != nil && lCol.Default != "" {
+		lDefault = lCol.Default
+		plan.add(table.Name, fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s DROP DEFAULT", quote(table.Name), quote(field.Name)),
+			"selection %s type change: drop default", field.Name)
+	}
+
+	if lEnum != "" {
+		plan.add(table.Name, fmt.Sprintf("CREATE TYPE %s AS ENUM (%s)", quote(lEnum), field.Selection.sqlList()),
+			"selection %s enum %s", field.Name, lEnum)
+		lType = quote(lEnum)
+	}
+	plan.add(table.Name, fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s TYPE %s USING %s::text::%s", quote(table.Name),
+		quote(field.Name), lType, quote(field.Name), lType), "selection %s change type to %s", field.Name, lType)
+
+	if lDefault != "" {
+		plan.add(table.Name, fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s SET DEFAULT %s", quote(table.Name), quote(field.Name), lDefault),
+			"selection %s type change: restore default", field.Name)
+	}
+
+	for _, name := range lOld {
+		plan.add(table.Name, fmt.Sprintf("DROP TYPE %s", quote(name)), "selection %s enum %s dropped: options changed", field.Name, name)
+	}
+}
+
+// sqlite 已有的表缺少约束时提示重建
+func (self *TOrm) noteSqliteChecks(plan *TSyncPlan, table *TTable) error {
+	if plan.tables[table.Name] {
+		return nil
+	}
+
+	ds, err := self.SqlQueryArgs("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = ?", table.Name)
+	if err != nil || ds.IsEmpty() {
+		return err
+	}
+
+	lSql := ds.Data[0].Get(0)
+	for _, fld := range table.storedSelections() {
+		lCheck, _ := self.selectionCheck(table.Name, fld)
+		if self.enforceOf(fld) == "check" && !strings.Contains(lSql, lCheck) {
+			plan.warn("Table %s selection %s check %s is created when the table is rebuilt", table.Name, fld.Name, lCheck)
+		}
+	}
+	return nil
+}
+
+// 表上的 CHECK 约束名称
+func (self *TOrm) checkConstraints(tableName string) ([]string, error) {
+	var lSql string
+	switch self.Dialect().DBType() {
+	case core.POSTGRES:
+		lSql = "SELECT c.conname FROM pg_constraint c JOIN pg_class t ON t.oid = c.conrelid " +
+			"WHERE t.relname = ? AND c.contype = 'c'"
+	case core.MYSQL:
+		lSql = "SELECT CONSTRAINT_NAME FROM information_schema.TABLE_CONSTRAINTS " +
+			"WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND CONSTRAINT_TYPE = 'CHECK'"
+	}
+	return self.queryNames(lSql, tableName)
+}
+
+// 表的字段使用的 ENUM 类型名称
+func (self *TOrm) enumTypes(tableName string) ([]string, error) {
+	return self.queryNames("SELECT DISTINCT t.typname FROM pg_type t JOIN pg_attribute a ON a.atttypid = t.oid "+
+		"JOIN pg_class c ON c.oid = a.attrelid WHERE c.relname = ? AND t.typtype = 'e'", tableName)
+}
+
+func (self *TOrm) queryNames(sql string, args ...interface{}) ([]string, error) {
+	ds, err := self.SqlQueryArgs(sql, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]string, 0, ds.Count())
+	for _, rec := range ds.Data {
+		res = append(res, rec.Get(0))
+	}
+	sort.Strings(res)
+	return res, nil
+}
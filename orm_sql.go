@@ -0,0 +1,217 @@
+package orm
+
+/** 参数绑定查询
+SQL 中统一使用 ? 作为占位符 执行前按数据库类型转换 参数交由驱动绑定而非拼接字符串
+*/
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"webgo/logger"
+
+	core "github.com/go-xorm/core"
+)
+
+// 将 ? 占位符转换为对应数据库的格式 postgres:$1,$2... mysql/sqlite:?
+// mysql 引号内的反斜杠转义如 'it\'s ?' 由驱动处理 SQL 不做转换
+func rebindSql(driver string, sql string) string {
+	if driver != "postgres" {
+		return sql
+	}
+
+	return replaceHolder(sql, func(idx int) string {
+		return "$" + strconv.Itoa(idx+1)
+	})
+}
+
+// 逐个替换 ? 占位符 引号内的 ? 不做替换
+// postgres 只在 E'...' 字符串中以反斜杠转义 普通字符串中的反斜杠为字符本身
+func replaceHolder(sql string, fn func(idx int) string) string {
+	var (
+		lBuf    bytes.Buffer
+		lQuote  rune // 当前所在引号 0 表示不在引号内
+		lEscape bool // 引号内以反斜杠转义
+		lSkip   bool // 上一字符为转义用的反斜杠
+		lPrev   rune
+		lIdx    = 0
+	)
+	for _, c := range sql {
+		switch {
+		case lQuote != 0:
+			switch {
+			case lSkip:
+				lSkip = false
+			case lEscape && c == '\\':
+				lSkip = true
+			case c == lQuote:
+				lQuote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			lQuote = c
+			lEscape = c == '\'' && (lPrev == 'E' || lPrev == 'e')
+		case c == '?':
+			lBuf.WriteString(fn(lIdx))
+			lIdx++
+			lPrev = c
+			continue
+		}
+		lBuf.WriteRune(c)
+		lPrev = c
+	}
+
+	return lBuf.String()
+}
+
+// sqlite 不一定支持 RETURNING 去掉后执行 主键由 LastInsertId 获得
+// 只去掉语句末尾引号外的 RETURNING <字段列表> 子句
+func stripReturning(driver string, sql string) string {
+	if driver != "sqlite3" {
+		return sql
+	}
+
+	if idx := returningClause(sql); idx > 0 {
+		return strings.TrimSpace(sql[:idx])
+	}
+	return sql
+}
+
+// 末尾 RETURNING 子句的位置 没有时返回 -1
+func returningClause(sql string) int {
+	var (
+		lQuote byte // 当前所在引号 0 表示不在引号内
+		lDepth = 0  // 括号层数 子查询中的 RETURNING 不处理
+		lPos   = -1
+	)
+	for i := 0; i < len(sql); i++ {
+		c := sql[i]
+		switch {
+		case lQuote != 0:
+			if c == lQuote {
+				lQuote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			lQuote = c
+		case c == '(':
+			lDepth++
+		case c == ')':
+			lDepth--
+		case lDepth == 0 && (i == 0 || !isIdentChar(sql[i-1])) && strings.HasPrefix(strings.ToLower(sql[i:]), "returning") &&
+			(i+9 == len(sql) || !isIdentChar(sql[i+9])):
+			lPos = i
+			i += 8
+		}
+	}
+	if lPos < 0 || lQuote != 0 {
+		return -1
+	}
+
+	// 其后只能是字段列表
+	lCols := strings.TrimRight(strings.TrimSpace(sql[lPos+9:]), ";")
+	if lCols == "" {
+		return -1
+	}
+	for i := 0; i < len(lCols); i++ {
+		if c := lCols[i]; !isIdentChar(c) && !strings.ContainsRune(" \t\r\n,.*\"`", rune(c)) {
+			return -1
+		}
+	}
+	return lPos
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// 读取所有行到数据集
+func rows2DataSet(rows *core.Rows, ds *TDataSet) (err error) {
+	defer rows.Close()
+
+	_, err = scanRows(rows, ds, -1)
+	return
+}
+
+// 按字段顺序扫描 limit 条记录到数据集 limit<0 时读取所有
+// 值保留原始类型 NULL 保存为 nil
+func scanRows(rows *core.Rows, ds *TDataSet, limit int) (cnt int, err error) {
+	lFields, err := rows.Columns()
+	if logger.LogErr(err) {
+		return
+	}
+
+	lTypes, err := rows.ColumnTypes()
+	if logger.LogErr(err) {
+		return
+	}
+
+	for (limit < 0 || cnt < limit) && rows.Next() {
+		lValues := make([]interface{}, len(lFields))
+		lDest := make([]interface{}, len(lFields))
+		for idx := range lValues {
+			lDest[idx] = &lValues[idx]
+		}
+
+		// 扫描出错时返回该错误 不再读取其后的记录
+		if err = rows.Scan(lDest...); logger.LogErr(err) {
+			return
+		}
+		cnt++
+
+		for idx, val := range lValues {
+			lValues[idx] = normalizeValue(lTypes[idx].DatabaseTypeName(), val)
+		}
+		ds.appendRecord(lFields, lValues)
+	}
+
+	// 打印错误
+	err = rows.Err()
+	logger.LogErr(err)
+	return
+}
+
+// 执行参数绑定的查询 SQL 以 ? 为占位符
+// 例如: orm.SqlQueryArgs("select * from res_user where name = ? and active = ?", name, true)
+func (self *TOrm) SqlQueryArgs(sql string, args ...interface{}) (ds *TDataSet, err error) {
+	// 无论如何都会返回一个Dataset
+	ds = NewDataSet()
+	ds.KeyField = "id"
+	ds.Orm = self
+
+	sql = rebindSql(self.DriverName(), sql)
+	if self.config.ShowSql {
+		logger.Logger.InfoLn("SqlQuery:", sql, args)
+	}
+
+	lRows, err := self.queryRows(sql, args...)
+	if logger.LogErr(err) {
+		return
+	}
+
+	err = rows2DataSet(lRows, ds)
+	return ds, err
+}
+
+// 执行参数绑定的查询 SQL 以 ? 为占位符
+// 事务中的查询使用该事务的连接 否则在只读库执行
+func (self *TOrmSession) QueryArgs(sql string, args ...interface{}) (ds *TDataSet, err error) {
+	sql = rebindSql(self.Orm.DriverName(), sql)
+	logger.Dbg("SqlQuery:", sql, args)
+
+	lRows, err := self.queryRows(sql, args...)
+	if logger.LogErr(err) {
+		return nil, err
+	}
+
+	ds = NewDataSet()
+	ds.KeyField = "id" //设置主键
+	ds.Orm = self.Orm
+
+	err = rows2DataSet(lRows, ds)
+	return ds, err
+}
+
+// 执行参数绑定的 SQL 以 ? 为占位符 事务中使用该事务的连接
+// 返回影响的记录数
+func (self *TOrmSession) ExecArgs(sql string, args ...interface{}) (int64, error) {
+	return self.execArgs(sql, args...)
+}
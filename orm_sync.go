@@ -0,0 +1,493 @@
+package orm
+
+/** 同步计划
+PlanSync 比较 Model 与数据库现有结构 生成按顺序执行的 DDL 及其原因 不执行任何修改
+审核后由 ApplyPlan 执行 postgres/sqlite 支持事务 DDL 计划在一个事务中执行
+Model 中不存在的索引按 TOrm.IndexPolicy 处理 默认只删除名称带 IDX_/UQE_ 前缀即由 ORM 创建的索引
+可能丢失数据的字段类型变更需设置 TOrm.AllowNarrowing 否则只给出警告
+例如:
+	plan, err := orm.PlanSync(new(ResPartner), new(ResUsers))
+	fmt.Print(plan)
+	err = orm.ApplyPlan(plan)
+*/
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	core "github.com/go-xorm/core"
+)
+
+const (
+	IndexOwned TIndexPolicy = iota // 只管理名称带 IDX_/UQE_ 前缀的索引 其他索引保留
+	IndexKeep                      // 保留所有 Model 中不存在的索引
+	IndexDrop                      // 删除所有 Model 中不存在的索引
+)
+
+type (
+	// 索引所有权策略
+	TIndexPolicy int
+
+	// 计划执行的一条 DDL
+	TSyncStep struct {
+		Table  string
+		Sql    string
+		Reason string // 如 new column, type change, index dropped
+	}
+
+	// 同步计划
+	TSyncPlan struct {
+		Steps    []*TSyncStep
+		Warnings []string // 无法自动同步的差异 如字段类型不一致
+		Notes    []string // 未修改的结构及原因 如按索引策略保留的索引
+
+		added  map[string]bool // 已计划的 SQL
+		tables map[string]bool // 计划中新建的表
+		models []*tSyncModel   // 计划执行后注册的映射
+	}
+
+	// 映射后待注册的 Model
+	tSyncModel struct {
+		Type     reflect.Type
+		table    *TTable
+		orgTable *core.Table
+	}
+)
+
+func newSyncPlan() *TSyncPlan {
+	return &TSyncPlan{
+		added:  make(map[string]bool),
+		tables: make(map[string]bool),
+	}
+}
+
+// 添加一条 DDL 相同的 SQL 只执行一次
+func (self *TSyncPlan) add(table, sql string, reason string, args ...interface{}) {
+	sql = strings.TrimRight(strings.TrimSpace(sql), ";")
+	if self.added[sql] {
+		return
+	}
+	self.added[sql] = true
+	self.Steps = append(self.Steps, &TSyncStep{
+		Table:  table,
+		Sql:    sql,
+		Reason: fmt.Sprintf(reason, args...),
+	})
+}
+
+func (self *TSyncPlan) warn(format string, args ...interface{}) {
+	self.Warnings = append(self.Warnings, fmt.Sprintf(format, args...))
+}
+
+func (self *TSyncPlan) note(format string, args ...interface{}) {
+	self.Notes = append(self.Notes, fmt.Sprintf(format, args...))
+}
+
+// 计划中是否无需执行的 DDL
+func (self *TSyncPlan) IsEmpty() bool {
+	return len(self.Steps) == 0
+}
+
+// 以 SQL 脚本格式输出 便于审核
+func (self *TSyncPlan) String() string {
+	var lBuf bytes.Buffer
+	for _, warn := range self.Warnings {
+		lBuf.WriteString("-- WARNING: " + warn + "\n")
+	}
+	for _, note := range self.Notes {
+		lBuf.WriteString("-- NOTE: " + note + "\n")
+	}
+	for _, step := range self.Steps {
+		lBuf.WriteString("-- " + step.Table + ": " + step.Reason + "\n")
+		lBuf.WriteString(step.Sql + ";\n")
+	}
+	return lBuf.String()
+}
+
+// 生成同步 models 所需的 DDL 不修改数据库
+// 已注册的映射不变 ApplyPlan 执行成功后才注册本批 Model many2many 关系表及外键在所有表之后
+// 所有 Model 的定义错误合并为一个 TModelErrors 此时不生成计划
+func (self *TOrm) PlanSync(models ...interface{}) (*TSyncPlan, error) {
+	return self.planSync(models, true)
+}
+
+func (self *TOrm) planSync(models []interface{}, comodels bool) (*TSyncPlan, error) {
+	// 在已注册映射的副本上映射及生成计划 使本批 Model 之间可以相互关联
+	return self.stageModels().planModels(models, comodels)
+}
+
+// 在 stageModels 返回的副本上执行
+func (self *TOrm) planModels(models []interface{}, comodels bool) (*TSyncPlan, error) {
+	lPlan := newSyncPlan()
+	lErrs := make(TModelErrors, 0)
+	lTables := make([]*TTable, 0, len(models))
+	lOrgTables := make([]*core.Table, 0, len(models))
+	for _, model := range models {
+		lTable, lOrgTable, err := self.mapModel(model)
+		if err != nil {
+			lErrs.merge(reflect.Indirect(reflect.ValueOf(model)).Type().Name(), err)
+			continue
+		}
+		lTables = append(lTables, lTable)
+		lOrgTables = append(lOrgTables, lOrgTable)
+		lPlan.models = append(lPlan.models, &tSyncModel{Type: lTable._cls_type, table: lTable, orgTable: lOrgTable})
+	}
+
+	// 所有 Model 映射后才能检查关联
+	for _, tbl := range lTables {
+		self.checkModel(&lErrs, tbl, comodels)
+	}
+	if len(lErrs) > 0 {
+		return nil, lErrs
+	}
+
+	lMetas, err := self.DBMetas() //获取原始ORM所有表
+	if err != nil {
+		return nil, err
+	}
+
+	for _, lOrgTable := range lOrgTables {
+		var lDbTable *core.Table
+		for _, tb := range lMetas {
+			if strings.EqualFold(tb.Name, lOrgTable.Name) {
+				lDbTable = tb
+				break
+			}
+		}
+
+		if lDbTable == nil {
+			self.planTable(lPlan, lOrgTable)
+		} else {
+			lDbTable = self.planRename(lPlan, lOrgTable, lDbTable)
+			if !self.planColumns(lPlan, lOrgTable, lDbTable) {
+				self.planIndexes(lPlan, lOrgTable, lDbTable)
+			}
+		}
+	}
+
+	// 关联字段的源字段可能在本批中才映射
+	self.setupRelated(lTables...)
+
+	// 创建 many2many 关系表
+	for _, tbl := range lTables {
+		if err = self.planMany2Many(lPlan, tbl); err != nil {
+			return nil, err
+		}
+	}
+
+	// 同步 many2one 外键
+	for _, tbl := range lTables {
+		if err = self.planForeignKeys(lPlan, tbl); err != nil {
+			return nil, err
+		}
+	}
+
+	// 选择字段的约束
+	for _, tbl := range lTables {
+		if err = self.planSelections(lPlan, tbl); err != nil {
+			return nil, err
+		}
+	}
+	return lPlan, nil
+}
+
+// 执行审核后的同步计划 支持事务 DDL 的数据库在一个事务中执行
+func (self *TOrm) ApplyPlan(plan *TSyncPlan) error {
+	sess := self.NewSession()
+	defer sess.Close()
+
+	fn := func() error {
+		for _, step := range plan.Steps {
+			self.Logger().Infof("Table %s %s: %s\n", step.Table, step.Reason, step.Sql)
+			if _, err := sess.Session.Exec(step.Sql); err != nil {
+				return fmt.Errorf("sync table %s (%s): %v", step.Table, step.Reason, err)
+			}
+		}
+		return nil
+	}
+
+	var err error
+	switch self.Dialect().DBType() {
+	case core.POSTGRES, core.SQLITE:
+		err = sess.transact(fn)
+	default:
+		err = fn()
+	}
+	if err != nil {
+		return err
+	}
+
+	self.registerModels(plan.models)
+	return nil
+}
+
+// 映射 Model 并保存到副本的列表 只在 stageModels 返回的副本上调用
+func (self *TOrm) mapModel(model interface{}) (*TTable, *core.Table, error) {
+	lType := reflect.Indirect(reflect.ValueOf(model)).Type()
+
+	// 循环嵌入使映射无限递归 须在映射前检查
+	if lCycle := embedCycle(lType, nil, nil); lCycle != nil {
+		return nil, nil, TModelErrors{{
+			Model: self.TableMapper.Obj2Table(lType.Name()),
+			Msg:   "cyclic embedding: " + strings.Join(lCycle, " -> "),
+		}}
+	}
+
+	lTable, lOrgTable, err := self.mapType(model, self.TableInfo(model)) // 更新自定义后的Table
+	if err != nil {
+		return nil, nil, err
+	}
+
+	self.Tables[lType] = lTable
+	self.nameIndex[lTable.Name] = lTable //添加表名称索引
+	self.staged[lType] = lOrgTable
+	return lTable, lOrgTable, nil
+}
+
+// 用于生成计划的副本 包含已注册映射的副本 共用数据库连接 不使用只读库
+// 映射只写入副本 定义错误或只生成计划时不影响已注册的 Model See registerModels()
+func (self *TOrm) stageModels() *TOrm {
+	self.modelLock.RLock()
+	defer self.modelLock.RUnlock()
+
+	res := &TOrm{
+		Engine:         self.Engine,
+		TagIdentifier:  self.TagIdentifier,
+		IndexPolicy:    self.IndexPolicy,
+		AllowNarrowing: self.AllowNarrowing,
+		Tables:         make(map[reflect.Type]*TTable, len(self.Tables)),
+		nameIndex:      make(map[string]*TTable, len(self.nameIndex)),
+		staged:         make(map[reflect.Type]*core.Table),
+		dbName:         self.dbName,
+		config:         self.config,
+	}
+	for t, tbl := range self.Tables {
+		res.Tables[t] = tbl
+	}
+	for name, tbl := range self.nameIndex {
+		res.nameIndex[name] = tbl
+	}
+	return res
+}
+
+// 注册计划中的映射 包括只读库
+// 映射列表不在原处修改 而是以包含新映射的副本整体替换 读取中的列表不受影响
+func (self *TOrm) registerModels(models []*tSyncModel) {
+	if len(models) == 0 {
+		return
+	}
+
+	self.modelLock.Lock()
+	lTables := make(map[reflect.Type]*TTable, len(self.Tables)+len(models))
+	for t, tbl := range self.Tables {
+		lTables[t] = tbl
+	}
+	lNames := make(map[string]*TTable, len(self.nameIndex)+len(models))
+	for name, tbl := range self.nameIndex {
+		lNames[name] = tbl
+	}
+	for _, m := range models {
+		lTables[m.Type] = m.table
+		lNames[m.table.Name] = m.table
+	}
+	self.Tables, self.nameIndex = lTables, lNames
+
+	self.Engine.Tables = withOrgTables(self.Engine.Tables, models)
+	for _, lReplica := range self.replicas {
+		lReplica.Tables = withOrgTables(lReplica.Tables, models)
+	}
+	self.modelLock.Unlock()
+
+	self.setupRelated()
+}
+
+// 原始表列表加上 models 的副本
+func withOrgTables(tables map[reflect.Type]*core.Table, models []*tSyncModel) map[reflect.Type]*core.Table {
+	res := make(map[reflect.Type]*core.Table, len(tables)+len(models))
+	for t, tbl := range tables {
+		res[t] = tbl
+	}
+	for _, m := range models {
+		res[m.Type] = m.orgTable
+	}
+	return res
+}
+
+// Model 映射后的原始表 副本中先查找本批的映射
+func (self *TOrm) orgTable(t reflect.Type) *core.Table {
+	if lTable, has := self.staged[t]; has {
+		return lTable
+	}
+
+	self.modelLock.RLock()
+	defer self.modelLock.RUnlock()
+	return self.Engine.Tables[t]
+}
+
+// 新建表及其唯一键和索引
+func (self *TOrm) planTable(plan *TSyncPlan, table *core.Table) {
+	plan.tables[table.Name] = true
+	plan.add(table.Name, self.createTableSql(table, ""), "new table")
+
+	lNames := indexNames(table.Indexes)
+	for _, name := range lNames {
+		if index := table.Indexes[name]; index.Type == core.UniqueType {
+			plan.add(table.Name, self.Dialect().CreateIndexSql(table.Name, index), "new unique %s", name)
+		}
+	}
+	for _, name := range lNames {
+		if index := table.Indexes[name]; index.Type == core.IndexType {
+			plan.add(table.Name, self.Dialect().CreateIndexSql(table.Name, index), "new index %s", name)
+		}
+	}
+}
+
+// 新增字段及字段类型/默认值/是否可空的变更 sqlite 重建表时返回 true
+func (self *TOrm) planColumns(plan *TSyncPlan, table, dbTable *core.Table) (rebuilt bool) {
+	lDiffs := make([]*columnDiff, 0)
+	for _, col := range table.Columns() {
+		// ENUM 类型由 planSelections 同步
+		if lOrgCol := dbTable.GetColumn(col.Name); lOrgCol != nil && !self.isEnumColumn(table, col.Name) {
+			if lDiff := self.diffColumn(plan, table.Name, col, lOrgCol); lDiff != nil {
+				lDiffs = append(lDiffs, lDiff)
+			}
+		}
+	}
+
+	// sqlite 不支持修改字段 重建表时包含新字段
+	if len(lDiffs) > 0 && self.Dialect().DBType() == core.SQLITE {
+		self.planRebuild(plan, table, dbTable, lDiffs)
+		return true
+	}
+
+	quote := self.Quote
+	for _, col := range table.Columns() {
+		if dbTable.GetColumn(col.Name) == nil {
+			plan.add(table.Name, fmt.Sprintf("ALTER TABLE %v ADD %v", quote(table.Name), col.String(self.Dialect())),
+				"new column %s", col.Name)
+		}
+	}
+
+	for _, diff := range lDiffs {
+		self.planAlterColumn(plan, table, diff)
+	}
+	return false
+}
+
+func (self TIndexPolicy) String() string {
+	switch self {
+	case IndexOwned:
+		return "owned"
+	case IndexKeep:
+		return "keep"
+	case IndexDrop:
+		return "drop"
+	}
+	return fmt.Sprintf("TIndexPolicy(%d)", int(self))
+}
+
+// 按策略 Model 中不存在的索引是否可删除
+// 名称带 IDX_/UQE_ 前缀的索引由 core 标记为 IsRegular
+func (self TIndexPolicy) owns(index *core.Index) bool {
+	switch self {
+	case IndexKeep:
+		return false
+	case IndexDrop:
+		return true
+	}
+	return index.IsRegular
+}
+
+// 变更索引 类型改变的索引被重建 Model 中不存在的索引按 IndexPolicy 删除或保留
+func (self *TOrm) planIndexes(plan *TSyncPlan, table, dbTable *core.Table) {
+	lFound := make(map[string]bool)
+	lAdded := make([]string, 0)
+	for _, name := range indexNames(table.Indexes) {
+		index := table.Indexes[name]
+
+		var lOrgIndex *core.Index
+		for _, name2 := range indexNames(dbTable.Indexes) {
+			if index2 := dbTable.Indexes[name2]; index.Equal(index2) {
+				lOrgIndex = index2
+				lFound[name2] = true
+				break
+			}
+		}
+
+		if lOrgIndex != nil && lOrgIndex.Type != index.Type {
+			// 非 ORM 创建的同列索引保留 另建 Model 的索引
+			if lOrgIndex.IsRegular || self.IndexPolicy == IndexDrop {
+				plan.add(table.Name, self.Dialect().DropIndexSql(table.Name, lOrgIndex), "index %s type changed", name)
+			} else {
+				plan.note("Table %s index %s kept: not created by the orm (index policy %s)", table.Name, lOrgIndex.Name, self.IndexPolicy)
+			}
+			lOrgIndex = nil
+		}
+
+		if lOrgIndex == nil {
+			lAdded = append(lAdded, name)
+		}
+	}
+
+	for _, name := range indexNames(dbTable.Indexes) {
+		if lFound[name] {
+			continue
+		}
+
+		index := dbTable.Indexes[name]
+		if self.IndexPolicy.owns(index) {
+			plan.add(table.Name, self.Dialect().DropIndexSql(table.Name, index),
+				"index %s dropped: not declared by the model (index policy %s)", name, self.IndexPolicy)
+		} else {
+			plan.note("Table %s index %s kept: not declared by the model (index policy %s)", table.Name, name, self.IndexPolicy)
+		}
+	}
+
+	for _, name := range lAdded {
+		index := table.Indexes[name]
+		if index.Type == core.UniqueType {
+			plan.add(table.Name, self.Dialect().CreateIndexSql(table.Name, index), "new unique %s", name)
+		} else if index.Type == core.IndexType {
+			plan.add(table.Name, self.Dialect().CreateIndexSql(table.Name, index), "new index %s", name)
+		}
+	}
+}
+
+// 建表 SQL postgres 实现继承
+// sqlite 不支持添加约束 many2one 外键及选择字段的 CHECK 约束在建表时创建
+// tableName 为空时使用 table.Name
+func (self *TOrm) createTableSql(table *core.Table, tableName string) string {
+	lSql := strings.TrimRight(strings.TrimSpace(self.Dialect().CreateTableSql(table, tableName, "", "")), ";")
+
+	lTable := self.TableByType(table.Type)
+	if lTable == nil {
+		return lSql
+	}
+
+	switch self.Dialect().DBType() {
+	case core.POSTGRES:
+		// 实现PG的继承
+		if len(lTable.Inherits) > 0 {
+			lSql += " INHERITS ( " + strings.Join(lTable.Inherits, ",") + " )"
+		}
+	case core.SQLITE:
+		lKeys := append(self.inlineForeignKeys(lTable), self.inlineChecks(lTable)...)
+		if len(lKeys) > 0 && strings.HasSuffix(lSql, ")") {
+			lSql = lSql[:len(lSql)-1] + ", " + strings.Join(lKeys, ", ") + ")"
+		}
+	}
+	return lSql
+}
+
+// 按名称排序的索引名
+func indexNames(indexes map[string]*core.Index) []string {
+	lNames := make([]string, 0, len(indexes))
+	for name := range indexes {
+		lNames = append(lNames, name)
+	}
+	sort.Strings(lNames)
+	return lNames
+}
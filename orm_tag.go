@@ -0,0 +1,250 @@
+package orm
+
+/** 字段 Tag 解析
+field:"..." Tag 由空格分隔的项组成 每项为 名称 名称(参数,...) 或 名称=参数
+参数可以是:
+	'字符串' 支持 '' 及 \' \\ 转义 可包含空格 逗号和括号
+	[...] {...} (...) 嵌套的 JSON 或表达式 原样保留 其中的 "字符串" 可包含任意字符
+	其他不含空格 逗号和括号的值
+例如:
+	field:"char() string('Partner''s Name') size(64) default='draft' selection({\"draft\":\"Draft\",\"done\":\"Done\"})"
+*/
+
+import (
+	"fmt"
+	"strings"
+)
+
+type (
+	// Tag 中的一项
+	TTagItem struct {
+		Name   string
+		Args   []string
+		Quoted []bool // 参数是否为单引号字符串
+		Pos    int    // 在 Tag 中的位置 从 1 开始
+	}
+
+	// Tag 解析错误
+	TTagError struct {
+		Model  string
+		Member string
+		Pos    int // 出错的位置 从 1 开始
+		Msg    string
+	}
+)
+
+func (self *TTagError) Error() string {
+	return fmt.Sprintf("model %s member %s: tag error at column %d: %s", self.Model, self.Member, self.Pos, self.Msg)
+}
+
+type tagParser struct {
+	tag string
+	pos int
+}
+
+// 解析 field Tag 错误为 *TTagError Model 和 Member 由 mapType 设置
+func parseFieldTag(tag string) (items []*TTagItem, err error) {
+	p := &tagParser{tag: tag}
+	for {
+		p.skipSpace()
+		if p.eof() {
+			return items, nil
+		}
+
+		lItem, err := p.item()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, lItem)
+
+		// 项之间必须以空格分隔
+		if !p.eof() && !isTagSpace(p.peek()) {
+			return nil, p.errorf(p.pos, "unexpected %q after %s", p.peek(), lItem.Name)
+		}
+	}
+}
+
+func (self *tagParser) eof() bool {
+	return self.pos >= len(self.tag)
+}
+
+func (self *tagParser) peek() byte {
+	return self.tag[self.pos]
+}
+
+func (self *tagParser) skipSpace() {
+	for !self.eof() && isTagSpace(self.peek()) {
+		self.pos++
+	}
+}
+
+func (self *tagParser) errorf(pos int, format string, args ...interface{}) *TTagError {
+	return &TTagError{Pos: pos + 1, Msg: fmt.Sprintf(format, args...)}
+}
+
+// 名称 名称(参数,...) 或 名称=参数
+func (self *tagParser) item() (*TTagItem, error) {
+	lStart := self.pos
+	for !self.eof() && !isTagSpace(self.peek()) && !strings.ContainsRune("(),=", rune(self.peek())) {
+		self.pos++
+	}
+	if self.pos == lStart {
+		return nil, self.errorf(lStart, "missing tag name before %q", self.peek())
+	}
+
+	lItem := &TTagItem{Name: self.tag[lStart:self.pos], Pos: lStart + 1}
+	if self.eof() {
+		return lItem, nil
+	}
+
+	switch self.peek() {
+	case '=':
+		self.pos++
+		if self.eof() || isTagSpace(self.peek()) {
+			return nil, self.errorf(self.pos, "missing value of %s", lItem.Name)
+		}
+
+		lArg, lQuoted, err := self.arg(true)
+		if err != nil {
+			return nil, err
+		}
+		lItem.Args = append(lItem.Args, lArg)
+		lItem.Quoted = append(lItem.Quoted, lQuoted)
+	case '(':
+		lOpen := self.pos
+		self.pos++
+		self.skipSpace()
+		if !self.eof() && self.peek() == ')' { // 空参数 如 char()
+			self.pos++
+			return lItem, nil
+		}
+
+		for {
+			self.skipSpace()
+			lArg, lQuoted, err := self.arg(false)
+			if err != nil {
+				return nil, err
+			}
+			lItem.Args = append(lItem.Args, lArg)
+			lItem.Quoted = append(lItem.Quoted, lQuoted)
+
+			self.skipSpace()
+			if self.eof() {
+				return nil, self.errorf(lOpen, "unclosed '(' of %s", lItem.Name)
+			}
+
+			lChar := self.peek()
+			self.pos++
+			if lChar == ')' {
+				break
+			}
+			if lChar != ',' {
+				return nil, self.errorf(self.pos-1, "unexpected %q in arguments of %s", lChar, lItem.Name)
+			}
+		}
+	case ')', ',':
+		return nil, self.errorf(self.pos, "unexpected %q after %s", self.peek(), lItem.Name)
+	}
+	return lItem, nil
+}
+
+// 一个参数 单引号字符串返回去掉引号及转义后的值 其他原样返回
+// bare 为 true 时 (名称=参数) 参数以空格结束
+func (self *tagParser) arg(bare bool) (string, bool, error) {
+	if !self.eof() && self.peek() == '\'' {
+		res, err := self.quoted()
+		return res, true, err
+	}
+
+	lStart := self.pos
+	lStack := make([]byte, 0) // 未闭合的括号
+	for !self.eof() {
+		lChar := self.peek()
+		if len(lStack) == 0 && (lChar == ',' || lChar == ')' || (bare && isTagSpace(lChar))) {
+			break
+		}
+
+		switch lChar {
+		case '(', '[', '{':
+			lStack = append(lStack, lChar)
+		case ')', ']', '}':
+			if len(lStack) == 0 || lStack[len(lStack)-1] != openBracket(lChar) {
+				return "", false, self.errorf(self.pos, "unbalanced %q", lChar)
+			}
+			lStack = lStack[:len(lStack)-1]
+		case '"', '\'':
+			if len(lStack) > 0 { // JSON 或表达式中的字符串
+				if err := self.skipString(lChar); err != nil {
+					return "", false, err
+				}
+				continue
+			}
+		}
+		self.pos++
+	}
+
+	if len(lStack) > 0 {
+		return "", false, self.errorf(self.pos, "missing closing bracket of %q", lStack[len(lStack)-1])
+	}
+	return strings.TrimSpace(self.tag[lStart:self.pos]), false, nil
+}
+
+// 单引号字符串 两个单引号或反斜杠转义
+func (self *tagParser) quoted() (string, error) {
+	lStart := self.pos
+	self.pos++
+
+	var lBuf []byte
+	for !self.eof() {
+		lChar := self.peek()
+		self.pos++
+		switch lChar {
+		case '\\':
+			if self.eof() {
+				return "", self.errorf(self.pos-1, "invalid escape at end of tag")
+			}
+			lBuf = append(lBuf, self.peek())
+			self.pos++
+		case '\'':
+			if !self.eof() && self.peek() == '\'' {
+				lBuf = append(lBuf, '\'')
+				self.pos++
+				continue
+			}
+			return string(lBuf), nil
+		default:
+			lBuf = append(lBuf, lChar)
+		}
+	}
+	return "", self.errorf(lStart, "unterminated string")
+}
+
+// 跳过嵌套括号中的字符串 保留原文
+func (self *tagParser) skipString(quote byte) error {
+	lStart := self.pos
+	self.pos++
+	for !self.eof() {
+		lChar := self.peek()
+		self.pos++
+		if lChar == '\\' {
+			self.pos++
+		} else if lChar == quote {
+			return nil
+		}
+	}
+	return self.errorf(lStart, "unterminated string")
+}
+
+func openBracket(close byte) byte {
+	switch close {
+	case ')':
+		return '('
+	case ']':
+		return '['
+	}
+	return '{'
+}
+
+func isTagSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
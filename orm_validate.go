@@ -0,0 +1,295 @@
+package orm
+
+/** 写入检查
+经会话的 Create/Write/ApplyUpdates/Insert/InsertOne/Update 写入前检查字段值 See _Validate()
+	required: 新建时必须有非空值 无值时使用数据库默认值 修改时不能改为空值
+	readonly: 不能写入 会话 Sudo() 后的下一次写入允许
+	size: 字符串长度(字符数)不超过 size
+	selection: 值必须是选项之一
+所有不符合的字段一起以 *TValidationError 返回 Exec 执行的原始 SQL 不检查
+计算字段的重算及反向方法写入的字段不检查
+*/
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"unicode/utf8"
+)
+
+type (
+	// 一个字段的错误
+	TFieldError struct {
+		Field  string
+		Reason string // required/readonly/size/selection
+		Msg    string
+	}
+
+	// 写入检查错误 列出所有不符合的字段
+	TValidationError struct {
+		Model  string
+		Fields []*TFieldError
+	}
+)
+
+func (self *TFieldError) Error() string {
+	return fmt.Sprintf("%s: %s", self.Field, self.Msg)
+}
+
+func (self *TValidationError) Error() string {
+	var lBuf bytes.Buffer
+	lBuf.WriteString("invalid values for " + self.Model + ":")
+	for idx, err := range self.Fields {
+		if idx > 0 {
+			lBuf.WriteString(";")
+		}
+		lBuf.WriteString(" " + err.Error())
+	}
+	return lBuf.String()
+}
+
+func (self *TValidationError) add(field, reason string, format string, args ...interface{}) {
+	self.Fields = append(self.Fields, &TFieldError{
+		Field:  field,
+		Reason: reason,
+		Msg:    fmt.Sprintf(format, args...),
+	})
+}
+
+// 下一次写入允许修改只读字段 写入结束后恢复检查
+// 例如: sess.Sudo().Write("res.partner", ids, values)
+func (self *TOrmSession) Sudo() *TOrmSession {
+	self.privileged = true
+	return self
+}
+
+// 开始一次写入 返回结束函数 最外层写入结束时清除 Sudo() 的权限及指定的字段
+// 写入中嵌套的写入(委托父记录 关联字段等)使用同一权限
+func (self *TOrmSession) writeScope() func() {
+	self.writeDepth++
+	return func() {
+		if self.writeDepth--; self.writeDepth == 0 {
+			self.privileged = false
+			self.clearCols()
+		}
+	}
+}
+
+func (self *TOrmSession) clearCols() {
+	self.cols = nil
+	self.mustCols = nil
+	self.allCols = false
+}
+
+// 记录 Cols()/MustCols() 指定的字段 参数可以是逗号分隔的多个字段
+func addCols(cols map[string]bool, columns []string) map[string]bool {
+	if cols == nil {
+		cols = make(map[string]bool)
+	}
+	for _, col := range columns {
+		for _, name := range strings.Split(col, ",") {
+			if name = strings.Trim(strings.TrimSpace(name), "`\""); name != "" {
+				cols[strings.ToLower(name)] = true
+			}
+		}
+	}
+	return cols
+}
+
+// 检查写入 table 的字段值 insert 为 true 时检查未提供的必填字段
+func (self *TOrmSession) _Validate(table *TTable, values map[string]interface{}, insert bool) error {
+	lErr := &TValidationError{Model: table.Name}
+	for _, name := range sortedKeys(values) {
+		lField := table.FieldByColumn(name)
+		if lField == nil {
+			continue
+		}
+
+		// 新建时只读字段可以为空
+		lValue := indirectValue(values[name])
+		if lField.Readonly && !self.privileged && !(insert && isEmptyValue(lField, lValue)) {
+			lErr.add(name, "readonly", "field is readonly")
+		}
+		if lField.Required && isEmptyValue(lField, lValue) {
+			lErr.add(name, "required", "field is required")
+			continue
+		}
+
+		if s, ok := lValue.(string); ok && lField.Size > 0 && int64(utf8.RuneCountInString(s)) > lField.Size {
+			lErr.add(name, "size", "length %d exceeds size %d", utf8.RuneCountInString(s), lField.Size)
+		}
+		if err := lField.checkSelection(lValue); err != nil {
+			lErr.add(name, "selection", "%v", err)
+		}
+	}
+
+	if insert {
+		for _, name := range sortedFields(table) {
+			lField := table.Fields[name]
+			if _, has := values[lField.Name]; has || !self.Orm.requiredOnInsert(table, lField) {
+				continue
+			}
+			lErr.add(lField.Name, "required", "field is required")
+		}
+	}
+
+	if len(lErr.Fields) > 0 {
+		return lErr
+	}
+	return nil
+}
+
+// 新建时须提供值的字段 不包括主键 计算字段 有默认值的字段及自动新建父记录的委托字段
+func (self *TOrm) requiredOnInsert(table *TTable, field *TField) bool {
+	if !field.Required || !field.Store || field.foreign_field || field.IsComputed() ||
+		field == table.RecordField || field.auto_increment || field.Default != nil {
+		return false
+	}
+
+	for _, rel := range table.InheritFields {
+		if rel.RelateFieldName == field.Name {
+			return false
+		}
+	}
+
+	if lOrgTable := self.orgTable(table._cls_type); lOrgTable != nil {
+		if lCol := lOrgTable.GetColumn(field.Name); lCol != nil && lCol.Default != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// 必填字段的空值 many2one 字段的 0 为空
+func isEmptyValue(field *TField, value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return true
+	case string:
+		return v == ""
+	case []byte:
+		return len(v) == 0
+	}
+	return field.Type == "many2one" && itf2Str(value) == "0"
+}
+
+// 检查数据集中新增及修改的记录 修改的记录只检查改变的字段
+func (self *TOrmSession) validateRecords(table *TTable, delta []*TRecordSet) error {
+	for _, rec := range delta {
+		if rec.State != RecInserted && rec.State != RecModified {
+			continue
+		}
+
+		lValues := make(map[string]interface{})
+		lNames, lVals := table.recordColumns(rec)
+		for idx, name := range lNames {
+			// 自增主键由数据库生成
+			if rec.State == RecInserted && name == table.RecordField.Name && lVals[idx] == nil {
+				continue
+			}
+			if _, has := rec.origin[name]; rec.State == RecModified && has && equal2Str(rec.origin[name], lVals[idx]) {
+				continue
+			}
+			lValues[name] = lVals[idx]
+		}
+
+		if err := self._Validate(table, lValues, rec.State == RecInserted); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 结构体中会写入的字段值 与 xorm 一致只有 Cols() 指定时只写入指定的字段
+// 字符串 []byte 及 many2one 的零值视为未提供 除非由 Cols()/MustCols()/AllCols() 指定
+// 其他类型的零值(如 0 false)照常写入 视为已提供
+func (self *TOrmSession) beanValues(table *TTable, bean reflect.Value) map[string]interface{} {
+	res := make(map[string]interface{})
+	for _, fld := range table.Fields {
+		if !fld.Store || fld.foreign_field || len(fld.member_index) == 0 {
+			continue
+		}
+		if len(self.cols) > 0 && !self.cols[strings.ToLower(fld.Name)] {
+			continue
+		}
+
+		lMember, ok := memberByIndex(bean, fld.member_index)
+		if !ok || !lMember.CanInterface() {
+			continue
+		}
+
+		lValue := lMember.Interface()
+		lMust := self.allCols || self.cols[strings.ToLower(fld.Name)] || self.mustCols[strings.ToLower(fld.Name)]
+		if !lMust && isEmptyValue(fld, indirectValue(lValue)) {
+			continue
+		}
+		res[fld.Name] = lValue
+	}
+	return res
+}
+
+// 按索引路径取成员 经过 nil 指针时返回 false
+func memberByIndex(value reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && value.Kind() == reflect.Ptr {
+			if value.IsNil() {
+				return value, false
+			}
+			value = value.Elem()
+		}
+		value = value.Field(x)
+	}
+	return value, true
+}
+
+// 检查 Insert/Update 的 Model 结构体或 Model 结构体的切片 未映射的类型不检查
+func (self *TOrmSession) validateBean(bean interface{}, insert bool) error {
+	lValue := reflect.Indirect(reflect.ValueOf(bean))
+	switch lValue.Kind() {
+	case reflect.Slice:
+		for i := 0; i < lValue.Len(); i++ {
+			if err := self.validateBean(lValue.Index(i).Interface(), insert); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		if lTable := self.Orm.TableByType(lValue.Type()); lTable != nil {
+			return self._Validate(lTable, self.beanValues(lTable, lValue), insert)
+		}
+	case reflect.Map:
+		// Table(...).Update(map) 按字段名检查
+		lMap, ok := bean.(map[string]interface{})
+		lTable := self.Orm.TableByName(self.Statement.TableName())
+		if ok && lTable != nil {
+			return self._Validate(lTable, lMap, insert)
+		}
+	}
+	return nil
+}
+
+func (self *TOrmSession) Insert(beans ...interface{}) (int64, error) {
+	defer self.writeScope()()
+	for _, bean := range beans {
+		if err := self.validateBean(bean, true); err != nil {
+			return 0, err
+		}
+	}
+	return self.Session.Insert(beans...)
+}
+
+func (self *TOrmSession) InsertOne(bean interface{}) (int64, error) {
+	defer self.writeScope()()
+	if err := self.validateBean(bean, true); err != nil {
+		return 0, err
+	}
+	return self.Session.InsertOne(bean)
+}
+
+func (self *TOrmSession) Update(bean interface{}, condiBean ...interface{}) (int64, error) {
+	defer self.writeScope()()
+	if err := self.validateBean(bean, false); err != nil {
+		return 0, err
+	}
+	return self.Session.Update(bean, condiBean...)
+}
@@ -0,0 +1,304 @@
+package orm
+
+/** 新建及修改记录
+values 以字段名为Key 计算字段通过其反向方法写入 关联字段写入到其关联的记录
+委托继承的表新建记录时先新建父记录 父表字段的值写入父记录
+写入后重新计算依赖被修改字段的存储计算字段
+写入前检查必填 只读 长度及选项 See _Validate()
+*/
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// 新建记录 返回新记录的主键
+func (self *TOrmSession) Create(model string, values map[string]interface{}) (id interface{}, err error) {
+	defer self.writeScope()()
+
+	lTable, err := self.Orm.tableOfModel(model)
+	if err != nil {
+		return nil, err
+	}
+
+	lStored, lInverse, err := lTable.splitValues(values)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = self._Validate(lTable, values, true); err != nil {
+		return nil, err
+	}
+
+	lKey := lTable.RecordField.Name
+	err = self.transact(func() error {
+		if err := self.createDelegates(lTable, lStored, lInverse); err != nil {
+			return err
+		}
+
+		ds := NewDataSet()
+		ds.Orm = self.Orm
+		ds.KeyField = lKey
+
+		lNames := sortedKeys(lStored)
+		lValues := make([]interface{}, 0, len(lNames))
+		for _, name := range lNames {
+			lValues = append(lValues, lStored[name])
+		}
+
+		lRec := ds.appendRecord(lNames, lValues)
+		lId, err := self.applyInsert(lTable, lRec)
+		if err != nil {
+			return err
+		}
+
+		id = lId
+		if id == nil {
+			return fmt.Errorf("Create: can not get the new record id of %s", model)
+		}
+		lIds := []interface{}{id}
+
+		if err := self.writeInverse(lTable, lIds, lInverse); err != nil {
+			return err
+		}
+
+		// 新记录的存储计算字段
+		for _, fld := range lTable.Fields {
+			if fld.IsComputed() && fld.Store {
+				if err := self.computeStored(lTable, fld, lIds); err != nil {
+					return err
+				}
+				lNames = append(lNames, fld.Name)
+			}
+		}
+		return self.recompute(lTable, lIds, lNames)
+	})
+	return
+}
+
+// 新建委托继承的父记录 并将父记录主键写入 many2one 字段
+// 已指定 many2one 字段值时父表字段写入到该父记录
+func (self *TOrmSession) createDelegates(table *TTable, stored, inverse map[string]interface{}) error {
+	lModels := make(map[string]string) // many2one 字段 -> 父表
+	for _, rel := range table.InheritFields {
+		if _, has := stored[rel.RelateFieldName]; !has {
+			lModels[rel.RelateFieldName] = rel.RelateTableName
+		}
+	}
+	if len(lModels) == 0 {
+		return nil
+	}
+
+	lParents := make(map[string]map[string]interface{})
+	for name := range lModels {
+		lParents[name] = make(map[string]interface{})
+	}
+	for name, val := range inverse {
+		if rel, has := table.InheritFields[name]; has && lParents[rel.RelateFieldName] != nil {
+			lParents[rel.RelateFieldName][name] = val
+			delete(inverse, name)
+		}
+	}
+
+	lNames := make([]string, 0, len(lModels))
+	for name := range lModels {
+		lNames = append(lNames, name)
+	}
+	sort.Strings(lNames)
+
+	for _, name := range lNames {
+		lId, err := self.Create(lModels[name], lParents[name])
+		if err != nil {
+			return err
+		}
+		stored[name] = lId
+	}
+	return nil
+}
+
+// 修改 ids 对应的记录
+func (self *TOrmSession) Write(model string, ids []interface{}, values map[string]interface{}) error {
+	defer self.writeScope()()
+
+	lTable, err := self.Orm.tableOfModel(model)
+	if err != nil {
+		return err
+	}
+
+	lStored, lInverse, err := lTable.splitValues(values)
+	if err != nil {
+		return err
+	}
+
+	if err = self._Validate(lTable, values, false); err != nil {
+		return err
+	}
+
+	if len(ids) == 0 {
+		return nil
+	}
+
+	return self.transact(func() error {
+		if err := self.updateRecords(lTable, ids, lStored); err != nil {
+			return err
+		}
+
+		if err := self.writeInverse(lTable, ids, lInverse); err != nil {
+			return err
+		}
+		return self.recompute(lTable, ids, sortedKeys(lStored))
+	})
+}
+
+// 拆分为存储字段及需通过反向方法写入的计算字段和关联字段
+func (self *TTable) splitValues(values map[string]interface{}) (stored, inverse map[string]interface{}, err error) {
+	stored = make(map[string]interface{})
+	inverse = make(map[string]interface{})
+	for name, val := range values {
+		lField := self.FieldByColumn(name)
+		switch {
+		case lField == nil:
+			return nil, nil, fmt.Errorf("unknown field %s of %s", name, self.Name)
+		case lField.IsRelatedPath():
+			inverse[name] = val
+		case lField.IsComputed():
+			if lField._fnct_inv == nil {
+				return nil, nil, fmt.Errorf("computed field %s of %s has no inverse method", name, self.Name)
+			}
+			inverse[name] = val
+		case !lField.Store || lField.foreign_field:
+			return nil, nil, fmt.Errorf("field %s of %s is not stored in %s", name, self.Name, self.Name)
+		default:
+			stored[name] = indirectValue(val)
+		}
+	}
+	return
+}
+
+// 以反向方法写入计算字段 关联字段写入到关联记录
+func (self *TOrmSession) writeInverse(table *TTable, ids []interface{}, values map[string]interface{}) error {
+	if len(values) == 0 {
+		return nil
+	}
+
+	lComputed := make(map[string]interface{})
+	for name, val := range values {
+		lField := table.FieldByColumn(name)
+		if !lField.IsRelatedPath() {
+			lComputed[name] = val
+			continue
+		}
+
+		if err := self.writeRelated(table, lField, ids, val); err != nil {
+			return err
+		}
+	}
+
+	values = lComputed
+	if len(values) == 0 {
+		return nil
+	}
+
+	ds, err := self.Read(table.Name, ids)
+	if err != nil {
+		return err
+	}
+
+	for _, rec := range ds.Data {
+		lId := []interface{}{rec._getByName(table.RecordField.Name)}
+		for _, name := range sortedKeys(values) {
+			lValues, err := table.inverseValue(table.FieldByColumn(name), rec, values[name])
+			if err != nil {
+				return err
+			}
+
+			lStored, _, err := table.splitValues(lValues)
+			if err != nil {
+				return fmt.Errorf("inverse of %s: %v", name, err)
+			}
+
+			if err = self.updateRecords(table, lId, lStored); err != nil {
+				return err
+			}
+			if err = self.recompute(table, lId, sortedKeys(lStored)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// 写入关联字段 如 partner_id.name 修改各记录 partner_id 指向的记录的 name 字段
+func (self *TOrmSession) writeRelated(table *TTable, field *TField, ids []interface{}, value interface{}) error {
+	lPos := strings.LastIndex(field.Related, ".")
+	if lPos < 0 {
+		return fmt.Errorf("related field %s of %s: invalid path %s", field.Name, table.Name, field.Related)
+	}
+	lPath, lName := field.Related[:lPos], field.Related[lPos+1:]
+
+	lRelate := self.Orm.relatedField(table, lPath, 0)
+	if lRelate == nil || lRelate.Type != "many2one" {
+		return fmt.Errorf("related field %s of %s: %s is not a many2one field", field.Name, table.Name, lPath)
+	}
+
+	ds, err := self.Read(table.Name, ids, lPath)
+	if err != nil {
+		return err
+	}
+
+	// 多条记录可能指向同一关联记录
+	lIds := make([]interface{}, 0, len(ds.Data))
+	lAdded := make(map[string]bool)
+	for _, rec := range ds.Data {
+		lId := rec._getByName(lPath)
+		if lId == nil || lAdded[itf2Str(lId)] {
+			continue
+		}
+		lAdded[itf2Str(lId)] = true
+		lIds = append(lIds, lId)
+	}
+
+	return self.Write(lRelate.comodel_name, lIds, map[string]interface{}{lName: value})
+}
+
+// 更新数据库字段
+func (self *TOrmSession) updateRecords(table *TTable, ids []interface{}, values map[string]interface{}) error {
+	if len(values) == 0 || len(ids) == 0 {
+		return nil
+	}
+
+	quote := self.Engine.Quote
+	lSets := make([]string, 0, len(values))
+	lArgs := make([]interface{}, 0, len(values)+len(ids))
+	for _, name := range sortedKeys(values) {
+		lSets = append(lSets, quote(name)+" = ?")
+		lArgs = append(lArgs, values[name])
+	}
+	lArgs = append(lArgs, ids...)
+
+	_, err := self.execArgs(fmt.Sprintf("UPDATE %s SET %s WHERE %s IN (%s)", quote(table.Name),
+		strings.Join(lSets, ", "), quote(table.RecordField.Name), holders(len(ids))), lArgs...)
+	return err
+}
+
+// Model 对应的表 必须有主键
+func (self *TOrm) tableOfModel(model string) (*TTable, error) {
+	lTable := self.TableByModel(model)
+	if lTable == nil {
+		return nil, fmt.Errorf("unknown model %s", model)
+	}
+	if lTable.RecordField == nil {
+		return nil, fmt.Errorf("model %s has no record field", model)
+	}
+	return lTable, nil
+}
+
+func sortedKeys(values map[string]interface{}) []string {
+	lKeys := make([]string, 0, len(values))
+	for key := range values {
+		lKeys = append(lKeys, key)
+	}
+	sort.Strings(lKeys)
+	return lKeys
+}